@@ -0,0 +1,297 @@
+package usbmuxd
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxAPIBody 管理接口请求体上限
+const maxAPIBody = 1 << 20
+
+// DeviceStatus 设备状态
+type DeviceStatus struct {
+	*DeviceInfo
+	Job *JobRecord `json:"job,omitempty"` // 最近一次任务
+}
+
+// DeviceList 已插入的目标设备, 按 UDID 排序
+func (controler *DeviceControler) DeviceList() []DeviceStatus {
+	list := []DeviceStatus{}
+	if controler.Devices == nil {
+		return list
+	}
+	controler.Devices.Range(func(key, value any) bool {
+		list = append(list, controler.deviceStatus(value.(*USBDevice)))
+		return true
+	})
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].UDID < list[j].UDID
+	})
+	return list
+}
+
+func (controler *DeviceControler) deviceStatus(device *USBDevice) DeviceStatus {
+	info := device.Info
+	if info == nil {
+		info = &DeviceInfo{UDID: device.UDID, DeviceID: device.ID, ProductID: device.Product}
+	}
+	status := DeviceStatus{DeviceInfo: info}
+	if jobs := controler.Jobs(device.UDID); len(jobs) > 0 {
+		status.Job = &jobs[len(jobs)-1]
+	}
+	return status
+}
+
+// APIHandler 管理接口(JSON)
+//
+//	GET  /devices               设备列表
+//	GET  /devices/{udid}        设备详情
+//	GET  /devices/{udid}/jobs   设备任务记录
+//	GET  /devices/{udid}/logs   设备日志, ?limit=N 返回最近 N 条
+//	POST /devices/{udid}/action 执行动作, 请求体为 JobStep, 如 {"action":"command","args":["uname -a"]}
+//	GET  /jobs                  任务记录
+//	GET  /jobs/{id}             任务详情
+//	GET  /queue                 排队状态
+//	GET  /events                事件流(Server-Sent Events, 设置 Events 时), 参数见 EventBus.ServeHTTP
+//	GET  /metrics               指标(设置 Metrics 时)
+//
+// 设置 APIToken 时请求需带 "Authorization: Bearer <APIToken>";
+// Host 须为 IP、localhost 或 APIAddr 中的主机名, 带 Origin 的请求须与 Host 同源(防止网页跨站请求与 DNS 重绑定);
+// POST 请求体须为 application/json.
+func (controler *DeviceControler) APIHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/devices", controler.apiDevices)
+	mux.HandleFunc("/devices/", controler.apiDevice)
+	mux.HandleFunc("/jobs", controler.apiJobs)
+	mux.HandleFunc("/jobs/", controler.apiJob)
+	mux.HandleFunc("/queue", controler.apiQueue)
+	mux.HandleFunc("/events", controler.apiEvents)
+	if controler.Metrics != nil {
+		mux.Handle("/metrics", controler.Metrics)
+	}
+	return controler.apiGuard(mux)
+}
+
+// apiGuard 校验令牌、Host 与 Origin
+func (controler *DeviceControler) apiGuard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !controler.apiHostAllowed(r.Host) {
+			writeError(w, http.StatusForbidden, fmt.Errorf("host %q not allowed", r.Host))
+			return
+		}
+		if origin := r.Header.Get("Origin"); origin != "" {
+			if u, err := url.Parse(origin); err != nil || !strings.EqualFold(u.Host, r.Host) {
+				writeError(w, http.StatusForbidden, fmt.Errorf("origin %q not allowed", origin))
+				return
+			}
+		}
+		if controler.APIToken != "" {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(controler.APIToken)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="usbmuxd"`)
+				writeError(w, http.StatusUnauthorized, errors.New("invalid or missing api token"))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// apiHostAllowed Host 为 IP、localhost 或 APIAddr 中的主机名
+func (controler *DeviceControler) apiHostAllowed(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if host == "" {
+		return false
+	}
+	if net.ParseIP(host) != nil || strings.EqualFold(host, "localhost") {
+		return true
+	}
+	if addrHost, _, err := net.SplitHostPort(controler.APIAddr); err == nil && addrHost != "" {
+		return strings.EqualFold(host, addrHost)
+	}
+	return false
+}
+
+// serveAPI 在 addr 上开启管理接口, Close 时关闭
+func (controler *DeviceControler) serveAPI(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("api listen: %w", err)
+	}
+	controler.server = &http.Server{
+		Handler:           controler.APIHandler(),
+		ReadHeaderTimeout: 10 * time.Second,
+		// Close 取消 ctx 时结束事件流等长连接
+		BaseContext: func(net.Listener) context.Context { return controler.context() },
+	}
+	controler.logger().Info("api listening", "op", "api", "addr", ln.Addr().String())
+	if controler.APIToken == "" {
+		controler.logger().Warn("api has no token, any local process can run commands on devices", "op", "api")
+	}
+	go func() {
+		if err := controler.server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			controler.logger().Error("api server stopped", "op", "api", "error", err)
+		}
+	}()
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	w.Write(buf.Bytes())
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+// allowMethod 检查请求方法, 不允许时返回 405
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method || (method == http.MethodGet && r.Method == http.MethodHead) {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	return false
+}
+
+func (controler *DeviceControler) apiDevices(w http.ResponseWriter, r *http.Request) {
+	if allowMethod(w, r, http.MethodGet) {
+		writeJSON(w, http.StatusOK, controler.DeviceList())
+	}
+}
+
+func (controler *DeviceControler) apiDevice(w http.ResponseWriter, r *http.Request) {
+	udid, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/devices/"), "/")
+	if udid == "" {
+		writeError(w, http.StatusNotFound, ErrDeviceNotFound)
+		return
+	}
+	switch sub {
+	case "":
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		device := controler.Device(udid)
+		if device == nil {
+			writeError(w, http.StatusNotFound, fmt.Errorf("%w: %s", ErrDeviceNotFound, udid))
+			return
+		}
+		writeJSON(w, http.StatusOK, controler.deviceStatus(device))
+	case "jobs":
+		if allowMethod(w, r, http.MethodGet) {
+			writeJSON(w, http.StatusOK, controler.Jobs(udid))
+		}
+	case "logs":
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		value, ok := controler.logs.Load(udid)
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Errorf("no logs for %s", udid))
+			return
+		}
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		writeJSON(w, http.StatusOK, value.(*LogBuffer).Entries(limit))
+	case "action":
+		if allowMethod(w, r, http.MethodPost) {
+			controler.apiAction(w, r, udid)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (controler *DeviceControler) apiAction(w http.ResponseWriter, r *http.Request, udid string) {
+	// 只接受 JSON, 网页无法不经预检发送此类跨站请求
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != "application/json" {
+		writeError(w, http.StatusUnsupportedMediaType, errors.New("content type must be application/json"))
+		return
+	}
+	var js JobStep
+	decoder := json.NewDecoder(io.LimitReader(r.Body, maxAPIBody))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&js); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("parse action: %w", err))
+		return
+	}
+	step, err := js.Step()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	record, err := controler.StartJob(udid, []*Step{step})
+	if errors.Is(err, ErrDeviceNotFound) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("/jobs/%d", record.ID))
+	writeJSON(w, http.StatusAccepted, record)
+}
+
+func (controler *DeviceControler) apiJobs(w http.ResponseWriter, r *http.Request) {
+	if allowMethod(w, r, http.MethodGet) {
+		writeJSON(w, http.StatusOK, controler.Jobs(r.URL.Query().Get("udid")))
+	}
+}
+
+func (controler *DeviceControler) apiJob(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/jobs/"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusNotFound, errors.New("invalid job id"))
+		return
+	}
+	record, ok := controler.JobByID(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("job %d not found", id))
+		return
+	}
+	writeJSON(w, http.StatusOK, record)
+}
+
+func (controler *DeviceControler) apiQueue(w http.ResponseWriter, r *http.Request) {
+	if allowMethod(w, r, http.MethodGet) {
+		writeJSON(w, http.StatusOK, controler.QueueStatus())
+	}
+}
+
+func (controler *DeviceControler) apiEvents(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	if controler.Events == nil {
+		writeError(w, http.StatusNotFound, errors.New("events not enabled"))
+		return
+	}
+	controler.Events.ServeHTTP(w, r)
+}
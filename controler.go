@@ -1,173 +1,522 @@
 package usbmuxd
 
 import (
-	"log"
-	"strings"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 //DeviceControler 设备处理
 type DeviceControler struct {
-	UserName     string
-	Password     string
-	Target       string
-	Command      []string
-	UpdateDEB    string
-	UpdateFiles  []string
-	RunApp       string
-	InstallApp   string
-	UninstallApp string
-	Reboot       bool
-
-	DeviceCount int
+	UserName       string
+	Password       string
+	SSHAuth        *SSHAuth    //密钥/agent 认证, nil 只使用密码
+	KnownHosts     *KnownHosts //按 UDID 校验设备主机密钥, nil 不校验
+	Target         string      //目标设备选择器(UDID 或选择器表达式, 见 Selector)
+	Command        []string
+	UpdateDEB      string
+	UpdateFiles    []string
+	RunApp         string
+	AppRunTime     time.Duration //运行 APP 时保持调试的时长, 见 USBDevice.AppRunTime
+	InstallApp     string
+	UninstallApp   string
+	Reboot         bool
+	Steps          []*Step              //执行步骤, 设置后忽略以上单项动作
+	Variables      map[string]string    //步骤参数模板变量, 参数中以 {{.名称}} 引用, 另有 UDID/DeviceID/ProductID
+	State          StateStore           //步骤完成状态, 设置后重新插入的设备从未完成的步骤继续
+	Pool           *WorkerPool          //并发控制, nil 为不限制
+	Priority       func(*USBDevice) int //设备排队优先级, 越大越先执行
+	APIAddr        string               //管理接口监听地址(如 127.0.0.1:8080), 为空不开启, 见 APIHandler
+	APIToken       string               //管理接口的 Bearer 令牌, 为空不校验
+	LogLines       int                  //每台设备保留的日志条数, 0 为 DefaultLogLines
+	JobHistory     int                  //保留的任务记录数, 0 为 DefaultJobHistory
+	SSHPool        *SSHPool             //按设备复用 SSH 连接, nil 时 Listen 创建; 设备拔出时关闭其连接
+	BandwidthLimit int64                //SFTP 每个传输的速率上限(字节/秒), 0 不限速
+	StrictVerify   bool                 //上传必须以 sha256 校验, 见 SSHUtil.StrictVerify
+
+	DeviceCount int //Deprecated: 正在处理的设备数的副本, 并发读取不安全; 使用 ActiveDevices
 	Devices     *sync.Map
+	Logger      Logger       //日志, nil 为 DefaultLogger
+	Metrics     *Metrics     //指标, nil 不记录
+	Events      *EventBus    //事件, nil 不发布; 开启 APIAddr 时自动创建
+	Results     []ResultSink //步骤结果与关闭时的汇总输出
 
 	OnPlug     func(*USBDevice) bool
 	OnUnPlug   func(*USBDevice)
 	OnProgress func(*USBDevice) error
+	OnTransfer func(*USBDevice, *TransferProgress) //文件传输进度(最多每 ProgressInterval 一次, 完成时 Done)
+
+	deviceCount int64
+	selector    *Selector
+	plugMu      sync.Mutex      //插入与拔出互斥(后台读取设备属性后插入)
+	lookups     lockdownLookups //正在读取设备属性的设备
+	ctx         context.Context
+	cancel      context.CancelFunc
+	listener    *USBListener
+	server      *http.Server
+	jobs        sync.WaitGroup
+	recordMu    sync.Mutex
+	recordID    int64
+	records     []*JobRecord
+	logs        sync.Map //UDID -> *LogBuffer
+	startedAt   time.Time
+	outcomes    map[string]*deviceOutcome
+	closeOnce   sync.Once
+}
+
+//DefaultJobHistory 默认保留的任务记录数
+const DefaultJobHistory = 200
+
+func (controler *DeviceControler) logger() Logger {
+	if controler.Logger == nil {
+		return DefaultLogger
+	}
+	return controler.Logger
+}
+
+//QueueStatus 排队与执行中的设备
+func (controler *DeviceControler) QueueStatus() PoolStatus {
+	return controler.Pool.Status()
+}
+
+//ActiveDevices 正在处理的设备数(并发安全)
+func (controler *DeviceControler) ActiveDevices() int {
+	return int(atomic.LoadInt64(&controler.deviceCount))
 }
 
 //NeedSSH 是否需要SSH连接
 func (controler *DeviceControler) NeedSSH() bool {
-	return len(controler.Command) > 0 ||
-		controler.UpdateDEB != "" ||
-		len(controler.UpdateFiles) >= 3 ||
-		controler.RunApp != "" ||
-		controler.InstallApp != "" ||
-		controler.UninstallApp != ""
+	for _, step := range controler.Pipeline() {
+		if step.NeedSSH() {
+			return true
+		}
+	}
+	return false
 }
 
 //Listen 开启监听
 func (controler *DeviceControler) Listen() error {
+	selector, err := ParseSelector(controler.Target)
+	if err != nil {
+		return err
+	}
+	controler.selector = selector
 	controler.Devices = &sync.Map{}
-	listener := &USBListener{
+	controler.ctx, controler.cancel = context.WithCancel(context.Background())
+	controler.startedAt = time.Now()
+	if controler.SSHPool == nil {
+		controler.SSHPool = NewSSHPool(0)
+	}
+	controler.listener = &USBListener{
 		Delegate: controler,
+		Logger:   controler.Logger,
+		Metrics:  controler.Metrics,
+		OnStateChange: func(state ListenerState, err error) {
+			event := Event{Type: EventListener, Data: state.String()}
+			if err != nil {
+				event.Error = err.Error()
+			}
+			controler.Events.Publish(event)
+		},
 	}
-	return listener.Listen()
+	if controler.APIAddr != "" {
+		if controler.Events == nil {
+			controler.Events = NewEventBus(0)
+		}
+		if err = controler.serveAPI(controler.APIAddr); err != nil {
+			return err
+		}
+	}
+	return controler.listener.Listen()
+}
+
+//Close 停止监听, 取消所有设备上进行中的操作并等待其退出, 之后向 Results 输出汇总(见 Summary)
+func (controler *DeviceControler) Close() {
+	controler.closeOnce.Do(func() {
+		if controler.cancel != nil {
+			controler.cancel()
+		}
+		if controler.listener != nil {
+			controler.listener.Close()
+		}
+		if controler.server != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			controler.server.Shutdown(ctx)
+			cancel()
+		}
+		controler.jobs.Wait()
+		controler.SSHPool.Close()
+		controler.reportSummary()
+	})
+}
+
+//context 设备 Context 的父 Context, Listen 之前为 Background
+func (controler *DeviceControler) context() context.Context {
+	if controler.ctx == nil {
+		return context.Background()
+	}
+	return controler.ctx
 }
 
 //USBDeviceDidPlug 设备进入
 func (controler *DeviceControler) USBDeviceDidPlug(frame *USBDeviceAttachedDetachedFrame) {
-	if controler.Target != "" && controler.Target != frame.Properties.SerialNumber {
-		log.Printf("device plug[%s] but not target", frame.Properties.SerialNumber)
+	info := NewDeviceInfo(frame)
+	if !controler.selector.NeedLockdown() {
+		controler.plug(frame, info)
 		return
 	}
-	log.Printf("device plug[%d]: %s %x", controler.DeviceCount, frame.Properties.SerialNumber, frame.Properties.ProductID)
-	controler.DeviceCount++
-	device := &USBDevice{ID: frame.DeviceID, UDID: frame.Properties.SerialNumber, Product: frame.Properties.ProductID, Pluged: true}
+	//ideviceinfo 较慢且设备刚插入时可能失败, 在单独协程中读取并重试, 不阻塞监听协程
+	controler.plugMu.Lock()
+	lookup, ctx := controler.lookups.add(controler.context(), frame)
+	controler.plugMu.Unlock()
+	controler.jobs.Add(1)
+	go func() {
+		defer controler.jobs.Done()
+		if err := info.loadLockdownRetry(ctx, controler.logger()); err != nil && ctx.Err() == nil {
+			controler.logger().Warn("read device info failed", "op", "plug", "udid", info.UDID, "device_id", info.DeviceID, "error", err)
+		}
+		controler.plugMu.Lock()
+		defer controler.plugMu.Unlock()
+		if frame := controler.lookups.done(lookup); frame != nil && controler.context().Err() == nil {
+			info.DeviceID = frame.DeviceID
+			controler.plug(frame, info)
+		}
+	}()
+}
+
+//plug 设备满足选择器时开始处理
+func (controler *DeviceControler) plug(frame *USBDeviceAttachedDetachedFrame, info *DeviceInfo) {
+	if !controler.selector.Match(info) {
+		controler.logger().Debug("device plugged but not target", "op", "plug", "udid", info.UDID, "device_id", info.DeviceID, "selector", controler.selector.String())
+		return
+	}
+	device := NewUSBDevice(controler.context(), frame)
+	device.Info = info
+	device.Logger = TeeLogger(controler.Logger, controler.DeviceLogs(device.UDID))
+	device.Metrics = controler.Metrics
+	device.AppRunTime = controler.AppRunTime
 	if controler.OnPlug != nil {
 		if !controler.OnPlug(device) {
+			device.Cancel()
 			return
 		}
 	}
 	controler.Devices.Store(frame.DeviceID, device)
-	go controler.progress(device)
+	count := atomic.AddInt64(&controler.deviceCount, 1)
+	controler.DeviceCount = int(count)
+	controler.Metrics.controlerDevices(count)
+	controler.logger().Info("device plugged", "op", "plug", "udid", frame.Properties.SerialNumber, "device_id", frame.DeviceID, "product", fmt.Sprintf("%x", frame.Properties.ProductID), "count", count)
+	controler.Events.Publish(Event{Type: EventDeviceAttached, UDID: device.UDID, DeviceID: device.ID, Data: info})
+	controler.jobs.Add(1)
+	go func() {
+		defer controler.jobs.Done()
+		controler.progress(device)
+	}()
 }
 
 //USBDeviceDidUnPlug 设备断开
 func (controler *DeviceControler) USBDeviceDidUnPlug(frame *USBDeviceAttachedDetachedFrame) {
-	log.Printf("device unplug[%d]: %s", controler.DeviceCount, frame.Properties.SerialNumber)
+	controler.plugMu.Lock()
+	defer controler.plugMu.Unlock()
+	controler.lookups.cancel(frame.DeviceID)
 	if value, ok := controler.Devices.LoadAndDelete(frame.DeviceID); ok {
-		controler.DeviceCount--
+		count := atomic.AddInt64(&controler.deviceCount, -1)
+		controler.DeviceCount = int(count)
+		controler.Metrics.controlerDevices(count)
+		controler.logger().Info("device unplugged", "op", "unplug", "udid", frame.Properties.SerialNumber, "device_id", frame.DeviceID, "count", count)
 		device := value.(*USBDevice)
 		device.Cancel()
+		controler.SSHPool.Remove(device.UDID)
+		controler.Events.Publish(Event{Type: EventDeviceDetached, UDID: device.UDID, DeviceID: device.ID})
 		if controler.OnUnPlug != nil {
 			controler.OnUnPlug(device)
 		}
 	}
 }
 
+//USBDeviceDidReattach usbmuxd 重启后设备仍在线, 更新设备 ID(Devices 改为以新 ID 为键)
+func (controler *DeviceControler) USBDeviceDidReattach(oldID int, frame *USBDeviceAttachedDetachedFrame) {
+	controler.plugMu.Lock()
+	defer controler.plugMu.Unlock()
+	controler.lookups.reattach(oldID, frame)
+	if value, ok := controler.Devices.LoadAndDelete(oldID); ok {
+		device := value.(*USBDevice)
+		device.Reattach(frame.DeviceID)
+		controler.Devices.Store(frame.DeviceID, device)
+		controler.logger().Info("device reattached", "op", "plug", "udid", frame.Properties.SerialNumber, "device_id", frame.DeviceID, "old_device_id", oldID)
+	}
+}
+
+//USBDeviceDidPair 设备配对
+func (controler *DeviceControler) USBDeviceDidPair(frame *USBDeviceAttachedDetachedFrame) {
+	controler.logger().Info("device paired", "op", "pair", "udid", frame.Properties.SerialNumber, "device_id", frame.DeviceID)
+	controler.Events.Publish(Event{Type: EventDevicePaired, UDID: frame.Properties.SerialNumber, DeviceID: frame.DeviceID})
+}
+
 //USBDidReceiveErrorWhilePluggingOrUnplugging 收到错误
 func (controler *DeviceControler) USBDidReceiveErrorWhilePluggingOrUnplugging(err error, msg string) {
+	controler.logger().Error("usbmuxd message error", "op", "listen", "error", err, "message", msg)
+	controler.Events.Publish(Event{Type: EventError, Error: err.Error(), Data: msg})
 }
 
-func (controler *DeviceControler) progress(device *USBDevice) {
+//Pipeline 设备执行的步骤, 未设置 Steps 时由 Command/UpdateDEB 等字段生成
+func (controler *DeviceControler) Pipeline() []*Step {
+	if len(controler.Steps) > 0 {
+		return controler.Steps
+	}
+	var steps []*Step
+	if len(controler.UpdateFiles) >= 3 {
+		steps = append(steps, &Step{Action: ActionUpload, Args: controler.UpdateFiles})
+	}
+	if controler.UpdateDEB != "" {
+		steps = append(steps, &Step{Action: ActionInstallDEB, Args: []string{controler.UpdateDEB}})
+	}
 	if len(controler.Command) > 0 {
-		su := device.SSH(controler.UserName, controler.Password)
-		defer su.Close()
-		if err := su.ConnectSSH(); err != nil {
-			log.Printf("[%s]connect ssh error: %v", device.UDID, err)
-			return
-		}
-		if err := su.Command(controler.Command[0], controler.Command[1:]); err != nil {
-			log.Printf("[%s]exec command error: %v", device.UDID, err)
-			return
+		steps = append(steps, &Step{Action: ActionCommand, Args: controler.Command})
+	}
+	if controler.InstallApp != "" {
+		steps = append(steps, &Step{Action: ActionInstallApp, Args: []string{controler.InstallApp}})
+	}
+	if controler.UninstallApp != "" {
+		steps = append(steps, &Step{Action: ActionUninstallApp, Args: []string{controler.UninstallApp}})
+	}
+	if controler.RunApp != "" {
+		steps = append(steps, &Step{Action: ActionRunApp, Args: []string{controler.RunApp}})
+	}
+	if controler.Reboot {
+		steps = append(steps, &Step{Action: ActionReboot})
+	}
+	return steps
+}
+
+func (controler *DeviceControler) progress(device *USBDevice) {
+	logger := device.logger()
+	if steps := controler.Pipeline(); len(steps) > 0 {
+		record := controler.newRecord(device.UDID, "plug", steps)
+		if err := controler.runJob(device, steps, record); err != nil {
+			logger.Error("job failed", "op", "pipeline", "job_id", record.ID, "error", err)
+		} else {
+			logger.Info("job finished", "op", "pipeline", "job_id", record.ID)
 		}
-		log.Printf("[%s]exec command finished", device.UDID)
 		return
 	}
-	if controler.UpdateDEB != "" {
-		su := device.SSH(controler.UserName, controler.Password)
-		defer su.Close()
-		if err := su.ConnectSSH(); err != nil {
-			log.Printf("[%s]connect ssh error: %v", device.UDID, err)
-			return
-		}
-		if err := su.ConnectSFTP(); err != nil {
-			log.Printf("[%s]connect sftp error: %v", device.UDID, err)
-			return
-		}
-		if err := su.InstallDEB(controler.UpdateDEB); err != nil {
-			log.Printf("[%s]install deb error: %v", device.UDID, err)
-			return
-		}
-		log.Printf("[%s]install deb finished", device.UDID)
+	if controler.OnProgress == nil {
 		return
 	}
-	if len(controler.UpdateFiles) >= 3 {
-		su := device.SSH(controler.UserName, controler.Password)
-		defer su.Close()
-		if err := su.ConnectSSH(); err != nil {
-			log.Printf("[%s]connect ssh error: %v", device.UDID, err)
-			return
-		}
-		if err := su.ConnectSFTP(); err != nil {
-			log.Printf("[%s]connect sftp error: %v", device.UDID, err)
-			return
+	ctx := device.Context()
+	var err error
+	for ctx.Err() == nil {
+		if err = controler.OnProgress(device); err != nil {
+			logger.Warn("progress callback failed", "op", "progress", "error", err)
+			if errors.Is(err, ErrDevicePortUnavailable) {
+				break
+			}
+			timer := time.NewTimer(5 * time.Second)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+			}
+		} else {
+			break
 		}
-		if err := su.UploadFiles(controler.UpdateFiles[0], controler.UpdateFiles[1], controler.UpdateFiles[2:]); err != nil {
-			log.Printf("[%s]upload file error: %v", device.UDID, err)
-			return
+	}
+	controler.Metrics.jobOutcome("progress", err)
+}
+
+//runJob 排队执行任务并更新任务记录
+func (controler *DeviceControler) runJob(device *USBDevice, steps []*Step, record *JobRecord) error {
+	priority := 0
+	if controler.Priority != nil {
+		priority = controler.Priority(device)
+	}
+	ticket, err := controler.Pool.Acquire(device.Context(), device.UDID, priority)
+	if err != nil {
+		err = context.Cause(device.Context())
+		controler.finishRecord(record, err)
+		return err
+	}
+	defer ticket.Release()
+	controler.updateRecord(record, func(record *JobRecord) {
+		record.State = JobRunning
+		record.StartedAt = time.Now()
+	})
+	controler.publishJob(EventJobStarted, record)
+	job := &Job{Device: device, controler: controler, ticket: ticket, record: record}
+	err = job.Run(steps)
+	controler.finishRecord(record, err)
+	return err
+}
+
+//newRecord 创建任务记录, 超出 JobHistory 时丢弃最早结束的记录
+func (controler *DeviceControler) newRecord(udid, source string, steps []*Step) *JobRecord {
+	record := &JobRecord{UDID: udid, Source: source, State: JobQueued, QueuedAt: time.Now()}
+	for _, step := range steps {
+		record.Steps = append(record.Steps, step.String())
+	}
+	history := controler.JobHistory
+	if history <= 0 {
+		history = DefaultJobHistory
+	}
+	controler.recordMu.Lock()
+	defer controler.recordMu.Unlock()
+	controler.recordID++
+	record.ID = controler.recordID
+	controler.records = append(controler.records, record)
+	for i := 0; len(controler.records) > history && i < len(controler.records); {
+		if controler.records[i].Done() {
+			controler.records = append(controler.records[:i], controler.records[i+1:]...)
+		} else {
+			i++
 		}
-		log.Printf("[%s]file uploaded", device.UDID)
+	}
+	controler.Events.Publish(Event{Type: EventJobQueued, UDID: udid, JobID: record.ID, Data: *record})
+	return record
+}
+
+//publishJob 发布任务事件, Data 为任务记录快照
+func (controler *DeviceControler) publishJob(eventType string, record *JobRecord) {
+	if controler.Events == nil || record == nil {
 		return
 	}
-	if controler.RunApp != "" {
-		if err := device.RunApp(controler.RunApp); err != nil {
-			log.Printf("[%s]app run error:: %v", device.UDID, err)
-		}
+	controler.recordMu.Lock()
+	snapshot := *record
+	controler.recordMu.Unlock()
+	controler.Events.Publish(Event{Type: eventType, UDID: snapshot.UDID, JobID: snapshot.ID, Step: snapshot.Step, Error: snapshot.Error, Data: snapshot})
+}
+
+//transferProgress 记录并发布文件传输进度
+func (controler *DeviceControler) transferProgress(device *USBDevice, record *JobRecord, progress *TransferProgress) {
+	controler.updateRecord(record, func(record *JobRecord) { record.Transfer = progress })
+	if progress.Done {
+		device.logger().Info("transfer finished", "op", "sftp_"+progress.Direction, "remote", progress.Remote,
+			"bytes", progress.Bytes, "rate", FormatBytes(int64(progress.Rate))+"/s")
+	}
+	if controler.OnTransfer != nil {
+		controler.OnTransfer(device, progress)
+	}
+	event := Event{Type: EventTransfer, UDID: device.UDID, DeviceID: device.ID, Data: progress}
+	if record != nil {
+		event.JobID = record.ID
+	}
+	controler.Events.Publish(event)
+}
+
+//updateRecord 修改任务记录
+func (controler *DeviceControler) updateRecord(record *JobRecord, update func(*JobRecord)) {
+	if record == nil {
 		return
 	}
-	if controler.InstallApp != "" {
-		if err := device.InstallAPP(controler.InstallApp); err != nil {
-			log.Printf("[%s]app install error: %v", device.UDID, err)
+	controler.recordMu.Lock()
+	update(record)
+	controler.recordMu.Unlock()
+}
+
+//finishRecord 记录任务结果
+func (controler *DeviceControler) finishRecord(record *JobRecord, err error) {
+	controler.updateRecord(record, func(record *JobRecord) {
+		record.FinishedAt = time.Now()
+		switch {
+		case err == nil:
+			record.State = JobSucceeded
+		case errors.Is(err, ErrDeviceDisconnected) || errors.Is(err, context.Canceled):
+			record.State = JobCanceled
+			record.Error = err.Error()
+		default:
+			record.State = JobFailed
+			record.Error = err.Error()
+		}
+		if controler.outcomes == nil {
+			controler.outcomes = make(map[string]*deviceOutcome)
+		}
+		controler.outcomes[record.UDID] = &deviceOutcome{state: record.State, err: record.Error}
+	})
+	controler.publishJob(EventJobFinished, record)
+}
+
+//Jobs 任务记录(按创建顺序), udid 不为空时只返回该设备的记录
+func (controler *DeviceControler) Jobs(udid string) []JobRecord {
+	controler.recordMu.Lock()
+	defer controler.recordMu.Unlock()
+	records := []JobRecord{}
+	for _, record := range controler.records {
+		if udid == "" || record.UDID == udid {
+			records = append(records, *record)
 		}
-		return
 	}
-	if controler.UninstallApp != "" {
-		if err := device.UninstallAPP(controler.UninstallApp); err != nil {
-			log.Printf("[%s]app uninstall error: %v", device.UDID, err)
+	return records
+}
+
+//JobByID 任务记录
+func (controler *DeviceControler) JobByID(id int64) (JobRecord, bool) {
+	controler.recordMu.Lock()
+	defer controler.recordMu.Unlock()
+	for _, record := range controler.records {
+		if record.ID == id {
+			return *record, true
 		}
-		return
 	}
-	if controler.Reboot {
-		if err := device.Reboot(); err != nil {
-			log.Printf("[%s]app uninstall error: %v", device.UDID, err)
+	return JobRecord{}, false
+}
+
+//DeviceLogs 设备日志缓存(拔出后保留)
+func (controler *DeviceControler) DeviceLogs(udid string) *LogBuffer {
+	if value, ok := controler.logs.Load(udid); ok {
+		return value.(*LogBuffer)
+	}
+	value, _ := controler.logs.LoadOrStore(udid, NewLogBuffer(controler.LogLines))
+	return value.(*LogBuffer)
+}
+
+//Device 按 UDID 查找已插入的目标设备
+func (controler *DeviceControler) Device(udid string) *USBDevice {
+	var found *USBDevice
+	if controler.Devices == nil {
+		return nil
+	}
+	controler.Devices.Range(func(key, value any) bool {
+		if device := value.(*USBDevice); device.UDID == udid {
+			found = device
+			return false
 		}
-		return
+		return true
+	})
+	return found
+}
+
+//StartJob 在设备上异步执行步骤(不记录完成状态), 返回任务记录
+func (controler *DeviceControler) StartJob(udid string, steps []*Step) (JobRecord, error) {
+	device := controler.Device(udid)
+	if device == nil {
+		return JobRecord{}, fmt.Errorf("%w: %s", ErrDeviceNotFound, udid)
 	}
-	if controler.OnProgress != nil {
-		for device.Pluged {
-			if err := controler.OnProgress(device); err != nil {
-				log.Printf("device[%s]: callback error(%v)", device.UDID, err)
-				if strings.Contains(err.Error(), ErrDevicePortUnavailable.Error()) {
-					break
-				}
-				time.Sleep(5 * time.Second)
-			} else {
-				break
-			}
+	if len(steps) == 0 {
+		return JobRecord{}, errors.New("no steps")
+	}
+	adhoc := make([]*Step, len(steps))
+	for i, step := range steps {
+		if err := step.Validate(); err != nil {
+			return JobRecord{}, err
 		}
+		copied := *step
+		copied.Always = true
+		adhoc[i] = &copied
 	}
+	record := controler.newRecord(udid, "api", adhoc)
+	snapshot := *record
+	controler.jobs.Add(1)
+	go func() {
+		defer controler.jobs.Done()
+		logger := device.logger()
+		if err := controler.runJob(device, adhoc, record); err != nil {
+			logger.Error("job failed", "op", "api", "job_id", record.ID, "error", err)
+		} else {
+			logger.Info("job finished", "op", "api", "job_id", record.ID)
+		}
+	}()
+	return snapshot, nil
 }
@@ -0,0 +1,209 @@
+package usbmuxd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 事件类型
+const (
+	EventListener       = "listener"          // usbmuxd 连接状态变化, Data 为状态
+	EventDeviceAttached = "device.attached"   // 目标设备插入, Data 为 DeviceInfo
+	EventDeviceDetached = "device.detached"   // 目标设备拔出
+	EventDevicePaired   = "device.paired"     // 设备完成配对(信任)
+	EventJobQueued      = "job.queued"        // 任务排队, Data 为 JobRecord
+	EventJobStarted     = "job.started"       // 任务开始执行
+	EventJobFinished    = "job.finished"      // 任务结束, Data 为 JobRecord
+	EventStepStarted    = "step.started"      // 步骤开始
+	EventStepFinished   = "step.finished"     // 步骤结束, 失败时 Error 不为空
+	EventTransfer       = "transfer.progress" // 文件传输进度, Data 为 TransferProgress
+	EventError          = "error"             // usbmuxd 消息错误
+)
+
+// DefaultEventHistory EventBus 默认保留的事件数(用于断线重连补发)
+const DefaultEventHistory = 256
+
+// Event 设备与任务事件
+type Event struct {
+	ID       int64     `json:"id"`
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	UDID     string    `json:"udid,omitempty"`
+	DeviceID int       `json:"device_id,omitempty"`
+	JobID    int64     `json:"job_id,omitempty"`
+	Step     string    `json:"step,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Data     any       `json:"data,omitempty"`
+}
+
+// EventBus 事件分发, 订阅者处理不及时(缓冲已满)时会被断开, 可凭最后的事件ID重新订阅补发
+type EventBus struct {
+	mu      sync.Mutex
+	size    int
+	seq     int64
+	history []Event
+	subs    map[chan Event]struct{}
+}
+
+// NewEventBus 创建事件分发, history 小于等于0 时为 DefaultEventHistory
+func NewEventBus(history int) *EventBus {
+	if history <= 0 {
+		history = DefaultEventHistory
+	}
+	return &EventBus{size: history, subs: make(map[chan Event]struct{})}
+}
+
+// Publish 发布事件, 自动填写 ID 与时间; bus 为 nil 时忽略
+func (bus *EventBus) Publish(event Event) {
+	if bus == nil {
+		return
+	}
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	bus.seq++
+	event.ID = bus.seq
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if len(bus.history) >= bus.size {
+		copy(bus.history, bus.history[1:])
+		bus.history = bus.history[:len(bus.history)-1]
+	}
+	bus.history = append(bus.history, event)
+	for ch := range bus.subs {
+		select {
+		case ch <- event:
+		default:
+			delete(bus.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// Subscribe 订阅事件, 返回 ID 大于 since 的历史事件(since 小于0 不补发)与后续事件通道
+// 通道关闭表示订阅已被断开; 调用返回的函数取消订阅
+func (bus *EventBus) Subscribe(since int64, buffer int) ([]Event, <-chan Event, func()) {
+	if buffer <= 0 {
+		buffer = 64
+	}
+	ch := make(chan Event, buffer)
+	bus.mu.Lock()
+	var backlog []Event
+	if since >= 0 {
+		for _, event := range bus.history {
+			if event.ID > since {
+				backlog = append(backlog, event)
+			}
+		}
+	}
+	bus.subs[ch] = struct{}{}
+	bus.mu.Unlock()
+	var once sync.Once
+	return backlog, ch, func() {
+		once.Do(func() {
+			bus.mu.Lock()
+			if _, ok := bus.subs[ch]; ok {
+				delete(bus.subs, ch)
+				close(ch)
+			}
+			bus.mu.Unlock()
+		})
+	}
+}
+
+// eventFilter 事件过滤, types 支持前缀匹配(如 job.*)
+type eventFilter struct {
+	types []string
+	udid  string
+}
+
+func (filter *eventFilter) match(event *Event) bool {
+	if filter.udid != "" && event.UDID != filter.udid {
+		return false
+	}
+	if len(filter.types) == 0 {
+		return true
+	}
+	for _, t := range filter.types {
+		if t == event.Type || (strings.HasSuffix(t, "*") && strings.HasPrefix(event.Type, strings.TrimSuffix(t, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeHTTP 以 Server-Sent Events 推送事件
+//
+//	?type=device.*,job.finished 按类型过滤(逗号分隔, 支持 * 后缀)
+//	?udid=UDID                  只推送该设备的事件
+//	Last-Event-ID 或 ?since=ID  补发该 ID 之后的历史事件
+func (bus *EventBus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	query := r.URL.Query()
+	filter := &eventFilter{udid: query.Get("udid")}
+	for _, t := range strings.Split(query.Get("type"), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			filter.types = append(filter.types, t)
+		}
+	}
+	since := int64(-1)
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		since, _ = strconv.ParseInt(id, 10, 64)
+	} else if id := query.Get("since"); id != "" {
+		since, _ = strconv.ParseInt(id, 10, 64)
+	}
+	backlog, events, cancel := bus.Subscribe(since, 0)
+	defer cancel()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "retry: 3000\n\n")
+	write := func(event *Event) bool {
+		if !filter.match(event) {
+			return true
+		}
+		data, err := json.Marshal(event)
+		if err != nil {
+			return true
+		}
+		_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+		return err == nil
+	}
+	for i := range backlog {
+		if !write(&backlog[i]) {
+			return
+		}
+	}
+	flusher.Flush()
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if !write(&event) {
+				return
+			}
+			flusher.Flush()
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,331 @@
+package usbmuxd
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 转发类型
+const (
+	ForwardLocal   = "local"   // 本地端口经设备连接目标地址(ssh -L)
+	ForwardRemote  = "remote"  // 设备端口经本机连接目标地址(ssh -R)
+	ForwardDynamic = "dynamic" // 本地 SOCKS5 代理, 经设备连接(ssh -D)
+)
+
+// Forwarder 一个端口转发, Close 停止监听并断开转发中的连接
+type Forwarder struct {
+	Kind   string // Forward* 常量
+	Target string // 目标地址, dynamic 为空
+
+	listener net.Listener
+	dial     func(addr string) (net.Conn, error)
+	logger   Logger
+	mu       sync.Mutex
+	conns    map[net.Conn]struct{}
+	closed   bool
+	wg       sync.WaitGroup
+	done     chan struct{}
+}
+
+// Addr 监听地址(监听端口为0 时为实际分配的端口)
+func (fwd *Forwarder) Addr() net.Addr {
+	return fwd.listener.Addr()
+}
+
+// Done 转发停止(Close、ctx 取消或 SSH 断开)后关闭
+func (fwd *Forwarder) Done() <-chan struct{} {
+	return fwd.done
+}
+
+// Close 停止监听并断开所有连接
+func (fwd *Forwarder) Close() error {
+	fwd.mu.Lock()
+	if fwd.closed {
+		fwd.mu.Unlock()
+		return nil
+	}
+	fwd.closed = true
+	err := fwd.listener.Close()
+	for conn := range fwd.conns {
+		conn.Close()
+	}
+	fwd.mu.Unlock()
+	fwd.wg.Wait()
+	return err
+}
+
+// track 记录连接, 已关闭时返回 false
+func (fwd *Forwarder) track(conn net.Conn) bool {
+	fwd.mu.Lock()
+	defer fwd.mu.Unlock()
+	if fwd.closed {
+		return false
+	}
+	fwd.conns[conn] = struct{}{}
+	return true
+}
+
+func (fwd *Forwarder) untrack(conn net.Conn) {
+	fwd.mu.Lock()
+	delete(fwd.conns, conn)
+	fwd.mu.Unlock()
+	conn.Close()
+}
+
+// serve 接受连接, 每个连接由 handle 处理
+func (fwd *Forwarder) serve(ctx context.Context, handle func(conn net.Conn)) {
+	stop := watchContext(ctx, fwd)
+	go func() {
+		defer close(fwd.done)
+		defer stop()
+		for {
+			conn, err := fwd.listener.Accept()
+			if err != nil {
+				fwd.mu.Lock()
+				closed := fwd.closed
+				fwd.mu.Unlock()
+				if !closed {
+					fwd.logger.Warn("port forward stopped", "op", "forward", "kind", fwd.Kind, "addr", fwd.Addr().String(), "error", err)
+					go fwd.Close()
+				}
+				return
+			}
+			if !fwd.track(conn) {
+				conn.Close()
+				return
+			}
+			fwd.wg.Add(1)
+			go func() {
+				defer fwd.wg.Done()
+				defer fwd.untrack(conn)
+				handle(conn)
+			}()
+		}
+	}()
+}
+
+// connect 连接目标并双向复制, 直到任一方向结束
+func (fwd *Forwarder) connect(conn net.Conn, target string) {
+	remote, err := fwd.dial(target)
+	if err != nil {
+		fwd.logger.Warn("port forward dial failed", "op", "forward", "kind", fwd.Kind, "target", target, "error", err)
+		return
+	}
+	if !fwd.track(remote) {
+		remote.Close()
+		return
+	}
+	defer fwd.untrack(remote)
+	join(conn, remote)
+}
+
+// join 双向复制, 一个方向结束后关闭两端
+func join(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(a, b)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(b, a)
+		done <- struct{}{}
+	}()
+	<-done
+	a.Close()
+	b.Close()
+	<-done
+}
+
+// newForwarder 创建转发, SSH 连接断开时关闭
+func (su *SSHUtil) newForwarder(kind, target string, listener net.Listener, dial func(addr string) (net.Conn, error)) *Forwarder {
+	su.logger().Info("port forward started", "op", "forward", "kind", kind, "addr", listener.Addr().String(), "target", target)
+	fwd := &Forwarder{
+		Kind:     kind,
+		Target:   target,
+		listener: listener,
+		dial:     dial,
+		logger:   su.logger(),
+		conns:    make(map[net.Conn]struct{}),
+		done:     make(chan struct{}),
+	}
+	disconnected := su.disconnected
+	go func() {
+		select {
+		case <-fwd.done:
+		case <-disconnected:
+			fwd.logger.Warn("port forward stopped, ssh disconnected", "op", "forward", "kind", kind, "addr", listener.Addr().String())
+			fwd.Close()
+		}
+	}()
+	return fwd
+}
+
+// sshDial 经设备连接地址
+func (su *SSHUtil) sshDial(addr string) (net.Conn, error) {
+	if su.sshclient == nil {
+		return nil, errors.New("ssh not connected")
+	}
+	return su.sshclient.Dial("tcp", addr)
+}
+
+// ForwardLocal 监听本地 localAddr, 连接经设备转发到 remoteAddr(如 127.0.0.1:8080), ctx 取消时停止
+func (su *SSHUtil) ForwardLocal(ctx context.Context, localAddr, remoteAddr string) (*Forwarder, error) {
+	if su.sshclient == nil {
+		return nil, errors.New("ssh not connected")
+	}
+	listener, err := net.Listen("tcp", localAddr)
+	if err != nil {
+		return nil, err
+	}
+	fwd := su.newForwarder(ForwardLocal, remoteAddr, listener, su.sshDial)
+	fwd.serve(ctx, func(conn net.Conn) { fwd.connect(conn, remoteAddr) })
+	return fwd, nil
+}
+
+// ForwardRemote 在设备上监听 remoteAddr, 连接经本机转发到 localAddr, ctx 取消时停止
+func (su *SSHUtil) ForwardRemote(ctx context.Context, remoteAddr, localAddr string) (*Forwarder, error) {
+	if su.sshclient == nil {
+		return nil, errors.New("ssh not connected")
+	}
+	listener, err := su.sshclient.Listen("tcp", remoteAddr)
+	if err != nil {
+		return nil, fmt.Errorf("remote listen %s: %w", remoteAddr, err)
+	}
+	var dialer net.Dialer
+	fwd := su.newForwarder(ForwardRemote, localAddr, listener, func(addr string) (net.Conn, error) {
+		return dialer.DialContext(ctx, "tcp", addr)
+	})
+	fwd.serve(ctx, func(conn net.Conn) { fwd.connect(conn, localAddr) })
+	return fwd, nil
+}
+
+// ForwardDynamic 在本地 localAddr 提供 SOCKS5 代理(无认证, 只支持 CONNECT), 连接经设备发出, ctx 取消时停止
+func (su *SSHUtil) ForwardDynamic(ctx context.Context, localAddr string) (*Forwarder, error) {
+	if su.sshclient == nil {
+		return nil, errors.New("ssh not connected")
+	}
+	listener, err := net.Listen("tcp", localAddr)
+	if err != nil {
+		return nil, err
+	}
+	fwd := su.newForwarder(ForwardDynamic, "", listener, su.sshDial)
+	fwd.serve(ctx, func(conn net.Conn) {
+		target, err := socks5Handshake(conn, socks5HandshakeTimeout)
+		if err != nil {
+			fwd.logger.Debug("socks handshake failed", "op", "forward", "kind", ForwardDynamic, "error", err)
+			return
+		}
+		remote, err := fwd.dial(target)
+		if err != nil {
+			fwd.logger.Warn("port forward dial failed", "op", "forward", "kind", ForwardDynamic, "target", target, "error", err)
+			conn.Write([]byte{socks5Version, socks5HostUnreachable, 0, socks5IPv4, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		if !fwd.track(remote) {
+			remote.Close()
+			return
+		}
+		defer fwd.untrack(remote)
+		// 绑定地址对客户端无意义, 回复 0.0.0.0:0
+		if _, err = conn.Write([]byte{socks5Version, socks5Succeeded, 0, socks5IPv4, 0, 0, 0, 0, 0, 0}); err != nil {
+			return
+		}
+		join(conn, remote)
+	})
+	return fwd, nil
+}
+
+// SOCKS5 协议常量(RFC 1928)
+const (
+	socks5Version           = 5
+	socks5NoAuth            = 0
+	socks5NoAcceptable      = 0xff
+	socks5Connect           = 1
+	socks5IPv4              = 1
+	socks5Domain            = 3
+	socks5IPv6              = 4
+	socks5Succeeded         = 0
+	socks5HostUnreachable   = 4
+	socks5CommandNotSupport = 7
+	socks5AddressNotSupport = 8
+)
+
+// socks5HandshakeTimeout SOCKS5 协商的超时, 避免不发送请求的客户端一直占用连接
+const socks5HandshakeTimeout = 10 * time.Second
+
+// socks5Handshake 在 timeout 内完成 SOCKS5 协商并读取 CONNECT 请求, 返回目标地址
+func socks5Handshake(conn net.Conn, timeout time.Duration) (string, error) {
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	if header[0] != socks5Version {
+		return "", fmt.Errorf("unsupported socks version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+	method := byte(socks5NoAcceptable)
+	for _, m := range methods {
+		if m == socks5NoAuth {
+			method = socks5NoAuth
+		}
+	}
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+		return "", err
+	}
+	if method == socks5NoAcceptable {
+		return "", errors.New("no acceptable socks auth method")
+	}
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return "", err
+	}
+	reply := func(code byte) {
+		conn.Write([]byte{socks5Version, code, 0, socks5IPv4, 0, 0, 0, 0, 0, 0})
+	}
+	if request[1] != socks5Connect {
+		reply(socks5CommandNotSupport)
+		return "", fmt.Errorf("unsupported socks command %d", request[1])
+	}
+	var host string
+	switch request[3] {
+	case socks5IPv4, socks5IPv6:
+		ip := make(net.IP, 4)
+		if request[3] == socks5IPv6 {
+			ip = make(net.IP, 16)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socks5Domain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return "", err
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		reply(socks5AddressNotSupport)
+		return "", fmt.Errorf("unsupported socks address type %d", request[3])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
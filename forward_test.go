@@ -0,0 +1,88 @@
+package usbmuxd
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSocks5Handshake(t *testing.T) {
+	greeting := []byte{socks5Version, 1, socks5NoAuth}
+	accepted := []byte{socks5Version, socks5NoAuth}
+	failed := func(code byte) []byte {
+		return []byte{socks5Version, code, 0, socks5IPv4, 0, 0, 0, 0, 0, 0}
+	}
+	join := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+	tests := []struct {
+		name   string
+		client []byte
+		target string
+		reply  []byte
+	}{
+		{"ipv4", join(greeting, []byte{5, socks5Connect, 0, socks5IPv4, 127, 0, 0, 1, 0, 80}), "127.0.0.1:80", accepted},
+		{"domain", join(greeting, []byte{5, socks5Connect, 0, socks5Domain, 11}, []byte("example.com"), []byte{1, 187}), "example.com:443", accepted},
+		{"ipv6", join(greeting, []byte{5, socks5Connect, 0, socks5IPv6}, net.IPv6loopback, []byte{0, 22}), "[::1]:22", accepted},
+		{"no auth among methods", join([]byte{socks5Version, 2, 2, socks5NoAuth}, []byte{5, socks5Connect, 0, socks5IPv4, 10, 0, 0, 1, 1, 0}), "10.0.0.1:256", accepted},
+		{"bad version", []byte{4, 1, socks5NoAuth}, "", nil},
+		{"no acceptable method", []byte{socks5Version, 1, 2}, "", []byte{socks5Version, socks5NoAcceptable}},
+		{"bind command", join(greeting, []byte{5, 2, 0, socks5IPv4, 127, 0, 0, 1, 0, 80}), "", join(accepted, failed(socks5CommandNotSupport))},
+		{"udp associate", join(greeting, []byte{5, 3, 0, socks5IPv4, 127, 0, 0, 1, 0, 80}), "", join(accepted, failed(socks5CommandNotSupport))},
+		{"unknown address type", join(greeting, []byte{5, socks5Connect, 0, 9}), "", join(accepted, failed(socks5AddressNotSupport))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			go client.Write(tt.client)
+			replies := make(chan []byte)
+			go func() {
+				data, _ := io.ReadAll(client)
+				replies <- data
+			}()
+			target, err := socks5Handshake(server, time.Second)
+			if tt.target == "" {
+				if err == nil {
+					t.Fatalf("handshake succeeded with target %q, want error", target)
+				}
+			} else if err != nil || target != tt.target {
+				t.Fatalf("handshake = %q, %v, want %q", target, err, tt.target)
+			}
+			server.Close()
+			if reply := <-replies; !bytes.Equal(reply, tt.reply) {
+				t.Fatalf("reply = %v, want %v", reply, tt.reply)
+			}
+		})
+	}
+}
+
+func TestSocks5HandshakeTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go client.Write([]byte{socks5Version})
+	if _, err := socks5Handshake(server, 20*time.Millisecond); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("stalled handshake error = %v, want deadline exceeded", err)
+	}
+
+	// 协商完成后清除超时, 之后的转发不受影响
+	client2, server2 := net.Pipe()
+	defer client2.Close()
+	defer server2.Close()
+	go func() {
+		client2.Write([]byte{socks5Version, 1, socks5NoAuth})
+		io.ReadFull(client2, make([]byte, 2))
+		client2.Write([]byte{5, socks5Connect, 0, socks5IPv4, 127, 0, 0, 1, 0, 80})
+	}()
+	if _, err := socks5Handshake(server2, 20*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	go client2.Write([]byte("ok"))
+	if _, err := io.ReadFull(server2, make([]byte, 2)); err != nil {
+		t.Fatalf("read after handshake: %v", err)
+	}
+}
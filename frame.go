@@ -0,0 +1,102 @@
+package usbmuxd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/zdypro888/go-plist"
+)
+
+// DefaultMaxFrameSize 默认最大消息长度(包含16字节头)
+const DefaultMaxFrameSize = 4 << 20
+
+const (
+	frameHeaderSize   = 16
+	framePlistVersion = 1
+	framePlistRequest = 8
+)
+
+// ErrFrameTooShort 消息长度小于头长度
+var ErrFrameTooShort = errors.New("usbmuxd frame shorter than header")
+
+// ErrFrameTooLarge 消息长度超过限制
+var ErrFrameTooLarge = errors.New("usbmuxd frame exceeds maximum size")
+
+// ErrFrameUnsupported 消息版本或类型不支持
+var ErrFrameUnsupported = errors.New("usbmuxd frame version not supported")
+
+// Frame usbmuxd 消息
+type Frame struct {
+	Version uint32
+	Request uint32
+	Tag     uint32
+	Payload []byte
+}
+
+// Decode 解析 plist 内容
+func (frame *Frame) Decode(v any) error {
+	return plist.NewDecoder(bytes.NewReader(frame.Payload)).Decode(v)
+}
+
+// FrameConn usbmuxd 消息读写
+type FrameConn struct {
+	rw      io.ReadWriter
+	MaxSize uint32
+}
+
+// NewFrameConn 创建消息读写(maxSize 为 0 时使用 DefaultMaxFrameSize)
+func NewFrameConn(rw io.ReadWriter, maxSize uint32) *FrameConn {
+	if maxSize == 0 {
+		maxSize = DefaultMaxFrameSize
+	}
+	return &FrameConn{rw: rw, MaxSize: maxSize}
+}
+
+// ReadFrame 读取一条消息
+func (fc *FrameConn) ReadFrame() (*Frame, error) {
+	headerBuf := make([]byte, frameHeaderSize)
+	if _, err := io.ReadFull(fc.rw, headerBuf); err != nil {
+		return nil, err
+	}
+	length := binary.LittleEndian.Uint32(headerBuf)
+	if length < frameHeaderSize {
+		return nil, fmt.Errorf("%w: length %d", ErrFrameTooShort, length)
+	}
+	if length > fc.MaxSize {
+		return nil, fmt.Errorf("%w: length %d > %d", ErrFrameTooLarge, length, fc.MaxSize)
+	}
+	frame := &Frame{
+		Version: binary.LittleEndian.Uint32(headerBuf[4:]),
+		Request: binary.LittleEndian.Uint32(headerBuf[8:]),
+		Tag:     binary.LittleEndian.Uint32(headerBuf[12:]),
+	}
+	if frame.Version != framePlistVersion || frame.Request != framePlistRequest {
+		return nil, fmt.Errorf("%w: version %d request %d", ErrFrameUnsupported, frame.Version, frame.Request)
+	}
+	frame.Payload = make([]byte, length-frameHeaderSize)
+	if _, err := io.ReadFull(fc.rw, frame.Payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return frame, nil
+}
+
+// WriteFrame 写入一条 plist 消息
+func (fc *FrameConn) WriteFrame(tag uint32, v any) error {
+	header := createHeader()
+	header.Tag = tag
+	buf, err := header.Command(v)
+	if err != nil {
+		return err
+	}
+	if header.Length > fc.MaxSize {
+		return fmt.Errorf("%w: length %d > %d", ErrFrameTooLarge, header.Length, fc.MaxSize)
+	}
+	_, err = fc.rw.Write(buf)
+	return err
+}
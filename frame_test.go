@@ -0,0 +1,123 @@
+package usbmuxd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+// rawFrame 按 usbmuxd 头格式拼接消息, length 为头中的长度字段
+func rawFrame(length, version, request, tag uint32, payload []byte) []byte {
+	buf := make([]byte, frameHeaderSize, frameHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(buf[0:], length)
+	binary.LittleEndian.PutUint32(buf[4:], version)
+	binary.LittleEndian.PutUint32(buf[8:], request)
+	binary.LittleEndian.PutUint32(buf[12:], tag)
+	return append(buf, payload...)
+}
+
+func TestReadFrameErrors(t *testing.T) {
+	payload := []byte("<plist/>")
+	valid := uint32(frameHeaderSize + len(payload))
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"short header", rawFrame(valid, framePlistVersion, framePlistRequest, 1, nil)[:10], io.ErrUnexpectedEOF},
+		{"length below header", rawFrame(frameHeaderSize-1, framePlistVersion, framePlistRequest, 1, nil), ErrFrameTooShort},
+		{"length zero", rawFrame(0, framePlistVersion, framePlistRequest, 1, nil), ErrFrameTooShort},
+		{"length above max", rawFrame(1025, framePlistVersion, framePlistRequest, 1, nil), ErrFrameTooLarge},
+		{"bad version", rawFrame(valid, 0, framePlistRequest, 1, payload), ErrFrameUnsupported},
+		{"bad request", rawFrame(valid, framePlistVersion, 3, 1, payload), ErrFrameUnsupported},
+		{"truncated payload", rawFrame(valid, framePlistVersion, framePlistRequest, 1, payload[:3]), io.ErrUnexpectedEOF},
+		{"missing payload", rawFrame(valid, framePlistVersion, framePlistRequest, 1, nil), io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fc := NewFrameConn(bytes.NewBuffer(tt.data), 1024)
+			frame, err := fc.ReadFrame()
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("ReadFrame error = %v, want %v", err, tt.want)
+			}
+			if frame != nil {
+				t.Fatalf("ReadFrame returned frame %+v with error", frame)
+			}
+		})
+	}
+}
+
+func TestReadFrame(t *testing.T) {
+	payload := []byte("<plist/>")
+	data := rawFrame(uint32(frameHeaderSize+len(payload)), framePlistVersion, framePlistRequest, 7, payload)
+	frame, err := NewFrameConn(bytes.NewBuffer(data), 0).ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.Version != framePlistVersion || frame.Request != framePlistRequest || frame.Tag != 7 || !bytes.Equal(frame.Payload, payload) {
+		t.Fatalf("unexpected frame %+v", frame)
+	}
+}
+
+func TestWriteFrameTooLarge(t *testing.T) {
+	var buf bytes.Buffer
+	fc := NewFrameConn(&buf, frameHeaderSize+8)
+	err := fc.WriteFrame(1, map[string]string{"MessageType": "Listen"})
+	if !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("WriteFrame error = %v, want %v", err, ErrFrameTooLarge)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("WriteFrame wrote %d bytes for oversized frame", buf.Len())
+	}
+}
+
+func FuzzReadFrame(f *testing.F) {
+	f.Add(rawFrame(frameHeaderSize+8, framePlistVersion, framePlistRequest, 1, []byte("<plist/>")), uint32(1), "Listen")
+	f.Add(rawFrame(frameHeaderSize, framePlistVersion, framePlistRequest, 0, nil), uint32(0), "")
+	f.Add(rawFrame(0xffffffff, framePlistVersion, framePlistRequest, 2, nil), uint32(0xffffffff), "Attached")
+	f.Add([]byte{1, 2, 3}, uint32(42), "\x00")
+	f.Fuzz(func(t *testing.T, data []byte, tag uint32, messageType string) {
+		// 任意输入不能 panic, 成功时 payload 长度与头一致
+		fc := NewFrameConn(bytes.NewBuffer(data), 1<<16)
+		if frame, err := fc.ReadFrame(); err == nil {
+			if length := binary.LittleEndian.Uint32(data); int(length) != frameHeaderSize+len(frame.Payload) {
+				t.Fatalf("payload length %d does not match header length %d", len(frame.Payload), length)
+			}
+		}
+
+		// WriteFrame 写入的消息 ReadFrame 读回后一致
+		var buf bytes.Buffer
+		fc = NewFrameConn(&buf, 1<<16)
+		message := map[string]string{"MessageType": messageType}
+		if err := fc.WriteFrame(tag, message); err != nil {
+			return
+		}
+		written := append([]byte(nil), buf.Bytes()...)
+		frame, err := fc.ReadFrame()
+		if err != nil {
+			t.Fatalf("ReadFrame after WriteFrame: %v", err)
+		}
+		if frame.Version != framePlistVersion || frame.Request != framePlistRequest || frame.Tag != tag {
+			t.Fatalf("header mismatch: %+v, tag %d", frame, tag)
+		}
+		if !bytes.Equal(frame.Payload, written[frameHeaderSize:]) {
+			t.Fatal("payload mismatch")
+		}
+		var decoded map[string]string
+		if err = frame.Decode(&decoded); err != nil {
+			t.Fatalf("Decode: %v", err)
+		}
+		if decoded["MessageType"] != messageType {
+			// plist 不能表示所有字符串(如控制字符), 重新编码后应一致
+			var again bytes.Buffer
+			if err = NewFrameConn(&again, 1<<16).WriteFrame(tag, decoded); err != nil || !bytes.Equal(again.Bytes(), written) {
+				t.Fatalf("MessageType %q decoded as %q", messageType, decoded["MessageType"])
+			}
+		}
+		if buf.Len() != 0 {
+			t.Fatalf("%d bytes left after ReadFrame", buf.Len())
+		}
+	})
+}
@@ -9,6 +9,8 @@ require (
 	github.com/zdypro888/go-plist v0.0.0-20230701023818-1de7c0434684
 	github.com/zdypro888/utils v0.0.0-20230701143214-cb20eea39e0e
 	golang.org/x/crypto v0.10.0
+	golang.org/x/term v0.9.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
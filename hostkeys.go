@@ -0,0 +1,208 @@
+package usbmuxd
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// ErrHostKeyChanged 设备主机密钥与记录不一致(严格模式)
+var ErrHostKeyChanged = errors.New("ssh host key changed")
+
+// knownHost known_hosts 中的一条记录
+type knownHost struct {
+	hosts []string
+	key   ssh.PublicKey
+	line  string // 原始行(非本程序写入的记录原样保留)
+}
+
+// KnownHosts 按设备 UDID 记录 SSH 主机密钥(首次连接时信任并记录)
+//
+// 文件为 known_hosts 格式, 主机名为 UDID(可为 ssh-keygen -H 哈希的主机名, 不支持通配); 通过 usbmuxd 连接时 ssh 看到的主机名只是端口号,
+// 无法区分同一 hub 端口上更换的设备.
+type KnownHosts struct {
+	Path   string
+	Strict bool // 密钥变化时拒绝连接(ErrHostKeyChanged); 否则记录警告并更新为新密钥
+
+	mu      sync.Mutex
+	entries []*knownHost
+}
+
+// NewKnownHosts 读取 known_hosts 文件, 文件不存在时在首次记录密钥时创建
+func NewKnownHosts(filePath string, strict bool) (*KnownHosts, error) {
+	kh := &KnownHosts{Path: filePath, Strict: strict}
+	data, err := os.ReadFile(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return kh, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		trimmed := bytes.TrimSpace(line)
+		if len(trimmed) == 0 || trimmed[0] == '#' {
+			continue
+		}
+		marker, hosts, key, _, _, err := ssh.ParseKnownHosts(trimmed)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", filePath, i+1, err)
+		}
+		entry := &knownHost{line: string(trimmed)}
+		if marker == "" {
+			entry.hosts, entry.key = hosts, key
+		}
+		kh.entries = append(kh.entries, entry)
+	}
+	return kh, nil
+}
+
+// hostMatches known_hosts 记录中的主机名是否为 host(已 Normalize), 支持 |1| 哈希的主机名, 不支持通配
+func hostMatches(pattern, host string) bool {
+	if !strings.HasPrefix(pattern, "|1|") {
+		return knownhosts.Normalize(pattern) == host
+	}
+	salt64, hash64, ok := strings.Cut(pattern[len("|1|"):], "|")
+	if !ok {
+		return false
+	}
+	salt, err := base64.StdEncoding.DecodeString(salt64)
+	if err != nil {
+		return false
+	}
+	hash, err := base64.StdEncoding.DecodeString(hash64)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(host))
+	return hmac.Equal(mac.Sum(nil), hash)
+}
+
+// lookup 主机的记录, 调用方需持有 mu
+func (kh *KnownHosts) lookup(host string) *knownHost {
+	host = knownhosts.Normalize(host)
+	for _, entry := range kh.entries {
+		for _, h := range entry.hosts {
+			if hostMatches(h, host) {
+				return entry
+			}
+		}
+	}
+	return nil
+}
+
+// Key 主机(UDID)记录的密钥, 无记录时返回 nil
+func (kh *KnownHosts) Key(host string) ssh.PublicKey {
+	kh.mu.Lock()
+	defer kh.mu.Unlock()
+	if entry := kh.lookup(host); entry != nil {
+		return entry.key
+	}
+	return nil
+}
+
+// Remove 删除主机记录(如设备重新越狱更换了密钥)
+func (kh *KnownHosts) Remove(host string) error {
+	kh.mu.Lock()
+	defer kh.mu.Unlock()
+	host = knownhosts.Normalize(host)
+	for i, entry := range kh.entries {
+		for _, h := range entry.hosts {
+			if hostMatches(h, host) {
+				kh.entries = append(kh.entries[:i], kh.entries[i+1:]...)
+				return kh.save()
+			}
+		}
+	}
+	return nil
+}
+
+// save 写入临时文件后重命名, 调用方需持有 mu
+func (kh *KnownHosts) save() error {
+	var buf bytes.Buffer
+	for _, entry := range kh.entries {
+		buf.WriteString(entry.line)
+		buf.WriteByte('\n')
+	}
+	if dir := filepath.Dir(kh.Path); dir != "" {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return err
+		}
+	}
+	tmpPath := kh.Path + ".tmp"
+	if err := os.WriteFile(tmpPath, buf.Bytes(), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, kh.Path)
+}
+
+// HostKeyAlgorithms 已记录密钥对应的算法, 使握手协商出同一类型的密钥; 无记录时返回 nil
+func (kh *KnownHosts) HostKeyAlgorithms(host string) []string {
+	key := kh.Key(host)
+	if key == nil {
+		return nil
+	}
+	if key.Type() == ssh.KeyAlgoRSA {
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	}
+	return []string{key.Type()}
+}
+
+// HostKeyCallback 校验主机(UDID)密钥: 无记录时记录, 一致时通过, 不一致时按 Strict 处理
+func (kh *KnownHosts) HostKeyCallback(host string, logger Logger) ssh.HostKeyCallback {
+	if logger == nil {
+		logger = DefaultLogger
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		kh.mu.Lock()
+		defer kh.mu.Unlock()
+		fingerprint := ssh.FingerprintSHA256(key)
+		entry := kh.lookup(host)
+		if entry == nil {
+			kh.entries = append(kh.entries, &knownHost{hosts: []string{host}, key: key, line: knownhosts.Line([]string{host}, key)})
+			logger.Info("ssh host key recorded", "op", "host_key", "host", host, "fingerprint", fingerprint)
+			return kh.save()
+		}
+		if bytes.Equal(entry.key.Marshal(), key.Marshal()) {
+			return nil
+		}
+		known := ssh.FingerprintSHA256(entry.key)
+		if kh.Strict {
+			logger.Error("ssh host key changed, refusing to connect", "op", "host_key", "host", host, "known", known, "fingerprint", fingerprint)
+			return fmt.Errorf("%w for %s: known %s, got %s", ErrHostKeyChanged, host, known, fingerprint)
+		}
+		logger.Warn("ssh host key changed, replacing", "op", "host_key", "host", host, "known", known, "fingerprint", fingerprint)
+		hosts := entry.hosts
+		if len(hosts) > 1 {
+			// 与其它主机共用的记录只移除该主机
+			normalized := knownhosts.Normalize(host)
+			rest := make([]string, 0, len(hosts)-1)
+			for _, h := range hosts {
+				if !hostMatches(h, normalized) {
+					rest = append(rest, h)
+				}
+			}
+			entry.hosts = rest
+			entry.line = knownhosts.Line(rest, entry.key)
+			kh.entries = append(kh.entries, &knownHost{hosts: []string{host}, key: key, line: knownhosts.Line([]string{host}, key)})
+		} else {
+			// 哈希的记录替换后仍写入哈希的主机名
+			lineHost := host
+			if strings.HasPrefix(hosts[0], "|1|") {
+				lineHost = knownhosts.HashHostname(knownhosts.Normalize(host))
+			}
+			entry.hosts, entry.key, entry.line = []string{lineHost}, key, knownhosts.Line([]string{lineHost}, key)
+		}
+		return kh.save()
+	}
+}
@@ -0,0 +1,103 @@
+package usbmuxd
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func testHostKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestKnownHostsLookup(t *testing.T) {
+	const udid = "00008030-001A2B3C4D5E6F70"
+	plain, hashed, ported, other := testHostKey(t), testHostKey(t), testHostKey(t), testHostKey(t)
+	lines := []string{
+		"# comment",
+		knownhosts.Line([]string{"other", udid}, plain),
+		knownhosts.Line([]string{knownhosts.HashHostname("hashed-udid")}, hashed),
+		knownhosts.Line([]string{"[ported]:2222"}, ported),
+		"|1|bm90IGJhc2U2NA|@@@ " + strings.SplitN(knownhosts.Line([]string{"x"}, other), " ", 2)[1],
+	}
+	filePath := filepath.Join(t.TempDir(), "known_hosts")
+	if err := os.WriteFile(filePath, []byte(strings.Join(lines, "\n")), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	kh, err := NewKnownHosts(filePath, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host string
+		want ssh.PublicKey
+	}{
+		{udid, plain},
+		{"other", plain},
+		{"[" + udid + "]:22", plain},
+		{"hashed-udid", hashed},
+		{"hashed-udid:22", hashed},
+		{"ported:2222", ported},
+		{"ported", nil},
+		{"missing", nil},
+		{"x", nil},
+	}
+	for _, tt := range tests {
+		got := kh.Key(tt.host)
+		if (got == nil) != (tt.want == nil) || got != nil && string(got.Marshal()) != string(tt.want.Marshal()) {
+			t.Errorf("Key(%q) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+
+	// 哈希的记录校验一致的密钥, 严格模式拒绝变化的密钥
+	callback := kh.HostKeyCallback("hashed-udid", nil)
+	if err := callback("127.0.0.1:22", nil, hashed); err != nil {
+		t.Fatalf("matching hashed key rejected: %v", err)
+	}
+	if err := callback("127.0.0.1:22", nil, other); !errors.Is(err, ErrHostKeyChanged) {
+		t.Fatalf("changed hashed key error = %v, want %v", err, ErrHostKeyChanged)
+	}
+
+	// 非严格模式替换哈希记录时仍写入哈希的主机名
+	kh.Strict = false
+	if err := callback("127.0.0.1:22", nil, other); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "hashed-udid") {
+		t.Fatalf("replaced hashed entry written in plain text:\n%s", data)
+	}
+	reloaded, err := NewKnownHosts(filePath, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key := reloaded.Key("hashed-udid"); key == nil || string(key.Marshal()) != string(other.Marshal()) {
+		t.Fatalf("replaced hashed key = %v, want %v", key, other)
+	}
+
+	if err := reloaded.Remove("hashed-udid"); err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.Key("hashed-udid") != nil {
+		t.Fatal("Remove did not remove the hashed entry")
+	}
+}
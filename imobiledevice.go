@@ -1,18 +1,24 @@
 package usbmuxd
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"os/exec"
 	"path"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/kardianos/osext"
 )
 
-func iMobileDeviceCMD(udid string) (string, string, string, string, string, error) {
+func iMobileDeviceCMD(ctx context.Context, udid string) (string, string, string, string, string, error) {
 	folder, err := osext.ExecutableFolder()
 	if err != nil {
 		return "", "", "", "", "", err
 	}
-	ideviceinfoCMD := exec.Command("ideviceinfo", "-u", udid, "-k", "ProductVersion")
+	ideviceinfoCMD := exec.CommandContext(ctx, "ideviceinfo", "-u", udid, "-k", "ProductVersion")
 	productVersion, err := ideviceinfoCMD.Output()
 	if err != nil {
 		return "", "", "", "", "", err
@@ -20,3 +26,48 @@ func iMobileDeviceCMD(udid string) (string, string, string, string, string, erro
 	DeveloperDiskImage := path.Join(folder, "DeviceSupport", string(productVersion[:4]), "DeveloperDiskImage.dmg")
 	return "ideviceinstaller", "ideviceimagemounter", DeveloperDiskImage, "idevicedebug", "idevicediagnostics", nil
 }
+
+func iMobileDeviceInfo(ctx context.Context, udid, key string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, "ideviceinfo", "-u", udid, "-k", key).Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// runTool 运行 libimobiledevice 命令, 返回合并的输出; 退出码不为0 时错误包含输出的最后一行
+// ctx 已取消(如步骤超时)时返回 ctx 的错误
+func runTool(ctx context.Context, cmd *exec.Cmd) (string, error) {
+	output, err := cmd.CombinedOutput()
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return string(output), ctxErr
+	}
+	if err != nil {
+		return string(output), toolError(cmd, err, string(output))
+	}
+	return string(output), nil
+}
+
+// toolError 命令失败的错误, 附带输出的最后一行
+func toolError(cmd *exec.Cmd, err error, output string) error {
+	name := filepath.Base(cmd.Path)
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if last := strings.TrimSpace(lines[len(lines)-1]); last != "" {
+		return fmt.Errorf("%s: %w: %s", name, err, last)
+	}
+	return fmt.Errorf("%s: %w", name, err)
+}
+
+// errInstaller ideviceinstaller 部分版本失败时退出码仍为0, 以输出中的 "ERROR:" 判断
+var errInstaller = errors.New("reported error")
+
+// runInstaller 运行 ideviceinstaller
+func runInstaller(ctx context.Context, cmd *exec.Cmd) error {
+	output, err := runTool(ctx, cmd)
+	if err == nil && strings.Contains(output, "ERROR:") {
+		err = toolError(cmd, errInstaller, output)
+	}
+	return err
+}
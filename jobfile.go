@@ -0,0 +1,235 @@
+package usbmuxd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Duration JSON 中的时长, 支持 "30s" 字符串或秒数
+type Duration time.Duration
+
+// UnmarshalJSON 解析时长
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		value, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		*d = Duration(value)
+		return nil
+	}
+	seconds, err := strconv.ParseFloat(string(data), 64)
+	if err != nil {
+		return fmt.Errorf("invalid duration %s", data)
+	}
+	*d = Duration(seconds * float64(time.Second))
+	return nil
+}
+
+// MarshalJSON 输出时长字符串
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// JobCredentials 登录凭据引用, 密码不直接写入任务文件
+type JobCredentials struct {
+	User         string `json:"user,omitempty"`
+	Password     string `json:"password,omitempty"`      // 明文密码(不推荐)
+	PasswordEnv  string `json:"password_env,omitempty"`  // 从环境变量读取密码
+	PasswordFile string `json:"password_file,omitempty"` // 从文件读取密码
+}
+
+// Resolve 读取凭据
+func (creds *JobCredentials) Resolve() (string, string, error) {
+	password := creds.Password
+	if creds.PasswordEnv != "" {
+		value, ok := os.LookupEnv(creds.PasswordEnv)
+		if !ok {
+			return "", "", fmt.Errorf("password env %s not set", creds.PasswordEnv)
+		}
+		password = value
+	}
+	if creds.PasswordFile != "" {
+		data, err := os.ReadFile(creds.PasswordFile)
+		if err != nil {
+			return "", "", err
+		}
+		password = strings.TrimRight(string(data), "\r\n")
+	}
+	return creds.User, password, nil
+}
+
+// JobRetry 步骤重试配置
+type JobRetry struct {
+	Attempts int      `json:"attempts,omitempty"`
+	Delay    Duration `json:"delay,omitempty"`
+}
+
+// JobStep 任务文件中的步骤
+type JobStep struct {
+	Name            string   `json:"name,omitempty"`
+	Action          string   `json:"action"`
+	Args            []string `json:"args,omitempty"`
+	Timeout         Duration `json:"timeout,omitempty"`
+	Retry           JobRetry `json:"retry,omitempty"`
+	ContinueOnError bool     `json:"continue_on_error,omitempty"`
+	Always          bool     `json:"always,omitempty"`
+}
+
+// JobFile 任务文件
+type JobFile struct {
+	Name        string            `json:"name,omitempty"`
+	Target      string            `json:"target,omitempty"` // 目标设备选择器, 见 Selector
+	Credentials JobCredentials    `json:"credentials,omitempty"`
+	Variables   map[string]string `json:"variables,omitempty"` // 步骤参数中可用 {{.名称}} 引用
+	Steps       []*JobStep        `json:"steps"`
+}
+
+// LoadJobFile 读取任务文件, 扩展名为 .yaml/.yml 时按 YAML 解析, 否则按 JSON 解析
+func LoadJobFile(filePath string) (*JobFile, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(filepath.Ext(filePath)) {
+	case ".yaml", ".yml":
+		return ParseJobFileYAML(data)
+	}
+	return ParseJobFile(data)
+}
+
+// ParseJobFileYAML 解析 YAML 任务文件, 字段名与 JSON 相同
+func ParseJobFileYAML(data []byte) (*JobFile, error) {
+	var value any
+	if err := yaml.Unmarshal(data, &value); err != nil {
+		return nil, fmt.Errorf("parse job file: %w", err)
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, fmt.Errorf("parse job file: %w", err)
+	}
+	return ParseJobFile(data)
+}
+
+// ParseJobFile 解析任务文件内容
+func ParseJobFile(data []byte) (*JobFile, error) {
+	jf := &JobFile{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(jf); err != nil {
+		return nil, fmt.Errorf("parse job file: %w", err)
+	}
+	if _, err := jf.Pipeline(); err != nil {
+		return nil, err
+	}
+	return jf, nil
+}
+
+// Pipeline 生成流水线步骤
+func (jf *JobFile) Pipeline() ([]*Step, error) {
+	if len(jf.Steps) == 0 {
+		return nil, errors.New("job file has no steps")
+	}
+	steps := make([]*Step, 0, len(jf.Steps))
+	for i, js := range jf.Steps {
+		step, err := js.Step()
+		if err != nil {
+			return nil, fmt.Errorf("step %d: %w", i+1, err)
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+// Step 生成流水线步骤并检查参数模板
+func (js *JobStep) Step() (*Step, error) {
+	step := &Step{
+		Name:            js.Name,
+		Action:          js.Action,
+		Args:            js.Args,
+		Timeout:         time.Duration(js.Timeout),
+		Retry:           RetryPolicy{Attempts: js.Retry.Attempts, Delay: time.Duration(js.Retry.Delay)},
+		ContinueOnError: js.ContinueOnError,
+		Always:          js.Always,
+	}
+	if err := step.Validate(); err != nil {
+		return nil, err
+	}
+	for _, arg := range step.Args {
+		if _, err := template.New(step.String()).Option("missingkey=error").Parse(arg); err != nil {
+			return nil, err
+		}
+	}
+	return step, nil
+}
+
+// Apply 将任务加载到 DeviceControler, 未设置的凭据保留原值
+func (jf *JobFile) Apply(controler *DeviceControler) error {
+	steps, err := jf.Pipeline()
+	if err != nil {
+		return err
+	}
+	user, password, err := jf.Credentials.Resolve()
+	if err != nil {
+		return err
+	}
+	if user != "" {
+		controler.UserName = user
+	}
+	if password != "" {
+		controler.Password = password
+	}
+	if jf.Target != "" {
+		controler.Target = jf.Target
+	}
+	controler.Variables = jf.Variables
+	controler.Steps = steps
+	return nil
+}
+
+// templateData 步骤参数模板变量
+func templateData(device *USBDevice, variables map[string]string) map[string]any {
+	data := make(map[string]any, len(variables)+3)
+	for key, value := range variables {
+		data[key] = value
+	}
+	data["UDID"] = device.UDID
+	data["DeviceID"] = device.ID
+	data["ProductID"] = device.Product
+	return data
+}
+
+// expandArgs 替换参数中的 {{.变量}}
+func expandArgs(args []string, data map[string]any) ([]string, error) {
+	expanded := make([]string, len(args))
+	for i, arg := range args {
+		if !strings.Contains(arg, "{{") {
+			expanded[i] = arg
+			continue
+		}
+		tmpl, err := template.New("arg").Option("missingkey=error").Parse(arg)
+		if err != nil {
+			return nil, err
+		}
+		var sb strings.Builder
+		if err = tmpl.Execute(&sb, data); err != nil {
+			return nil, err
+		}
+		expanded[i] = sb.String()
+	}
+	return expanded, nil
+}
@@ -0,0 +1,199 @@
+package usbmuxd
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testJobJSON = `{
+	"name": "deploy",
+	"target": "udid=abc",
+	"credentials": {"user": "mobile", "password_env": "TEST_JOB_PASSWORD"},
+	"variables": {"dir": "/var/tmp"},
+	"steps": [
+		{"action": "command", "args": ["mkdir -p {{.dir}}/{{.UDID}}"], "timeout": "30s"},
+		{"name": "install", "action": "install_deb", "args": ["pkg.deb"], "retry": {"attempts": 3, "delay": 1.5}, "continue_on_error": true},
+		{"action": "reboot", "always": true}
+	]
+}`
+
+const testJobYAML = `name: deploy
+target: udid=abc
+credentials:
+  user: mobile
+  password_env: TEST_JOB_PASSWORD
+variables:
+  dir: /var/tmp
+steps:
+  - action: command
+    args: ["mkdir -p {{.dir}}/{{.UDID}}"]
+    timeout: 30s
+  - name: install
+    action: install_deb
+    args: [pkg.deb]
+    retry: {attempts: 3, delay: 1.5}
+    continue_on_error: true
+  - action: reboot
+    always: true
+`
+
+func checkTestJob(t *testing.T, jf *JobFile) {
+	t.Helper()
+	if jf.Name != "deploy" || jf.Target != "udid=abc" || jf.Credentials.User != "mobile" || jf.Variables["dir"] != "/var/tmp" {
+		t.Fatalf("unexpected job file %+v", jf)
+	}
+	steps, err := jf.Pipeline()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(steps) != 3 {
+		t.Fatalf("got %d steps, want 3", len(steps))
+	}
+	if steps[0].Action != ActionCommand || steps[0].Timeout != 30*time.Second {
+		t.Fatalf("step 1 = %+v", steps[0])
+	}
+	if steps[1].Name != "install" || steps[1].Retry.Attempts != 3 || steps[1].Retry.Delay != 1500*time.Millisecond || !steps[1].ContinueOnError {
+		t.Fatalf("step 2 = %+v", steps[1])
+	}
+	if steps[2].Action != ActionReboot || !steps[2].Always {
+		t.Fatalf("step 3 = %+v", steps[2])
+	}
+}
+
+func TestLoadJobFile(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{"job.json": testJobJSON, "job.yaml": testJobYAML, "job.YML": testJobYAML} {
+		t.Run(name, func(t *testing.T) {
+			filePath := filepath.Join(dir, name)
+			if err := os.WriteFile(filePath, []byte(content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			jf, err := LoadJobFile(filePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkTestJob(t, jf)
+		})
+	}
+}
+
+func TestParseJobFileErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		parse func([]byte) (*JobFile, error)
+		data  string
+		want  string
+	}{
+		{"unknown field", ParseJobFile, `{"steps": [{"action": "reboot"}], "extra": 1}`, `unknown field "extra"`},
+		{"unknown step field", ParseJobFile, `{"steps": [{"action": "reboot", "tiemout": "1s"}]}`, `unknown field "tiemout"`},
+		{"yaml unknown field", ParseJobFileYAML, "steps:\n  - action: reboot\n    tiemout: 1s\n", `unknown field "tiemout"`},
+		{"no steps", ParseJobFile, `{"name": "empty"}`, "no steps"},
+		{"empty yaml", ParseJobFileYAML, "", "no steps"},
+		{"bad yaml", ParseJobFileYAML, "steps: [", "parse job file"},
+		{"unknown action", ParseJobFile, `{"steps": [{"action": "explode"}]}`, `unknown action "explode"`},
+		{"missing args", ParseJobFile, `{"steps": [{"action": "upload", "args": ["a"]}]}`, "needs 3 args"},
+		{"bad template", ParseJobFile, `{"steps": [{"action": "command", "args": ["echo {{.dir"]}]}`, "step 1"},
+		{"bad duration", ParseJobFile, `{"steps": [{"action": "reboot", "timeout": "soon"}]}`, "parse job file"},
+		{"bad duration value", ParseJobFile, `{"steps": [{"action": "reboot", "timeout": true}]}`, "invalid duration"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jf, err := tt.parse([]byte(tt.data))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("error = %v, want %q", err, tt.want)
+			}
+			if jf != nil {
+				t.Fatalf("returned job file %+v with error", jf)
+			}
+		})
+	}
+}
+
+func TestDurationJSON(t *testing.T) {
+	var d Duration
+	if err := d.UnmarshalJSON([]byte(`"1m30s"`)); err != nil || time.Duration(d) != 90*time.Second {
+		t.Fatalf("Duration = %v, %v", time.Duration(d), err)
+	}
+	if err := d.UnmarshalJSON([]byte(`0.25`)); err != nil || time.Duration(d) != 250*time.Millisecond {
+		t.Fatalf("Duration = %v, %v", time.Duration(d), err)
+	}
+	data, err := Duration(90 * time.Second).MarshalJSON()
+	if err != nil || string(data) != `"1m30s"` {
+		t.Fatalf("MarshalJSON = %s, %v", data, err)
+	}
+}
+
+func TestJobCredentialsResolve(t *testing.T) {
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(passwordFile, []byte("from-file\r\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_JOB_PASSWORD", "from-env")
+	tests := []struct {
+		name  string
+		creds JobCredentials
+		want  string
+	}{
+		{"plain", JobCredentials{User: "root", Password: "plain"}, "plain"},
+		{"env", JobCredentials{User: "root", Password: "plain", PasswordEnv: "TEST_JOB_PASSWORD"}, "from-env"},
+		{"file", JobCredentials{User: "root", PasswordEnv: "TEST_JOB_PASSWORD", PasswordFile: passwordFile}, "from-file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, password, err := tt.creds.Resolve()
+			if err != nil || user != "root" || password != tt.want {
+				t.Fatalf("Resolve = %q, %q, %v, want root, %q", user, password, err, tt.want)
+			}
+		})
+	}
+	if _, _, err := (&JobCredentials{PasswordEnv: "TEST_JOB_PASSWORD_UNSET"}).Resolve(); err == nil {
+		t.Fatal("Resolve with unset env succeeded")
+	}
+	if _, _, err := (&JobCredentials{PasswordFile: passwordFile + ".missing"}).Resolve(); err == nil {
+		t.Fatal("Resolve with missing file succeeded")
+	}
+}
+
+func TestJobFileApply(t *testing.T) {
+	t.Setenv("TEST_JOB_PASSWORD", "secret")
+	jf, err := ParseJobFile([]byte(testJobJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+	controler := &DeviceControler{UserName: "root", Password: "alpine", Target: "all"}
+	if err = jf.Apply(controler); err != nil {
+		t.Fatal(err)
+	}
+	if controler.UserName != "mobile" || controler.Password != "secret" || controler.Target != "udid=abc" || len(controler.Steps) != 3 {
+		t.Fatalf("unexpected controler after Apply: user %q, password %q, target %q, %d steps", controler.UserName, controler.Password, controler.Target, len(controler.Steps))
+	}
+
+	// 未设置的凭据与目标保留原值
+	jf = &JobFile{Steps: []*JobStep{{Action: ActionReboot}}}
+	controler = &DeviceControler{UserName: "root", Password: "alpine", Target: "all"}
+	if err = jf.Apply(controler); err != nil {
+		t.Fatal(err)
+	}
+	if controler.UserName != "root" || controler.Password != "alpine" || controler.Target != "all" {
+		t.Fatalf("Apply overwrote unset fields: user %q, password %q, target %q", controler.UserName, controler.Password, controler.Target)
+	}
+}
+
+func TestExpandArgs(t *testing.T) {
+	device := &USBDevice{ID: 3, UDID: "abc", Product: 4776}
+	data := templateData(device, map[string]string{"dir": "/var/tmp", "UDID": "shadowed"})
+	args, err := expandArgs([]string{"plain", "{{.dir}}/{{.UDID}}", "{{.DeviceID}}-{{.ProductID}}"}, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"plain", "/var/tmp/abc", "3-4776"}; !reflect.DeepEqual(args, want) {
+		t.Fatalf("expandArgs = %q, want %q", args, want)
+	}
+	if _, err = expandArgs([]string{"{{.missing}}"}, data); err == nil {
+		t.Fatal("expandArgs with missing variable succeeded")
+	}
+}
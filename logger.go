@@ -0,0 +1,207 @@
+package usbmuxd
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Logger 结构化日志接口, *slog.Logger 可直接使用
+// args 为交替的 key, value
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+// DefaultLogger 未设置 Logger 时使用的日志
+var DefaultLogger Logger = NewStdLogger(log.Default(), false)
+
+// StdLogger 使用标准库 log 输出 key=value 格式日志
+type StdLogger struct {
+	Logger *log.Logger
+	Debugs bool // 是否输出 Debug 日志
+}
+
+// NewStdLogger 创建标准库日志
+func NewStdLogger(logger *log.Logger, debug bool) *StdLogger {
+	return &StdLogger{Logger: logger, Debugs: debug}
+}
+
+func (sl *StdLogger) output(level, msg string, args []any) {
+	var sb strings.Builder
+	sb.WriteString(level)
+	sb.WriteByte(' ')
+	sb.WriteString(msg)
+	for i := 0; i < len(args); i += 2 {
+		if i+1 < len(args) {
+			fmt.Fprintf(&sb, " %v=%v", args[i], args[i+1])
+		} else {
+			fmt.Fprintf(&sb, " !BADKEY=%v", args[i])
+		}
+	}
+	sl.Logger.Print(sb.String())
+}
+
+// Debug 调试日志
+func (sl *StdLogger) Debug(msg string, args ...any) {
+	if sl.Debugs {
+		sl.output("DEBUG", msg, args)
+	}
+}
+
+// Info 信息日志
+func (sl *StdLogger) Info(msg string, args ...any) { sl.output("INFO", msg, args) }
+
+// Warn 警告日志
+func (sl *StdLogger) Warn(msg string, args ...any) { sl.output("WARN", msg, args) }
+
+// Error 错误日志
+func (sl *StdLogger) Error(msg string, args ...any) { sl.output("ERROR", msg, args) }
+
+type attrLogger struct {
+	logger Logger
+	attrs  []any
+}
+
+// WithAttrs 为日志附加固定属性(如 "udid", "device_id")
+func WithAttrs(logger Logger, attrs ...any) Logger {
+	if logger == nil {
+		logger = DefaultLogger
+	}
+	if parent, ok := logger.(*attrLogger); ok {
+		return &attrLogger{logger: parent.logger, attrs: append(append([]any{}, parent.attrs...), attrs...)}
+	}
+	return &attrLogger{logger: logger, attrs: attrs}
+}
+
+func (al *attrLogger) merge(args []any) []any {
+	return append(append(make([]any, 0, len(al.attrs)+len(args)), al.attrs...), args...)
+}
+
+func (al *attrLogger) Debug(msg string, args ...any) { al.logger.Debug(msg, al.merge(args)...) }
+func (al *attrLogger) Info(msg string, args ...any)  { al.logger.Info(msg, al.merge(args)...) }
+func (al *attrLogger) Warn(msg string, args ...any)  { al.logger.Warn(msg, al.merge(args)...) }
+func (al *attrLogger) Error(msg string, args ...any) { al.logger.Error(msg, al.merge(args)...) }
+
+type teeLogger []Logger
+
+// TeeLogger 同时输出到多个日志, nil 使用 DefaultLogger
+func TeeLogger(loggers ...Logger) Logger {
+	tee := make(teeLogger, len(loggers))
+	for i, logger := range loggers {
+		if logger == nil {
+			logger = DefaultLogger
+		}
+		tee[i] = logger
+	}
+	return tee
+}
+
+func (tee teeLogger) Debug(msg string, args ...any) {
+	for _, logger := range tee {
+		logger.Debug(msg, args...)
+	}
+}
+
+func (tee teeLogger) Info(msg string, args ...any) {
+	for _, logger := range tee {
+		logger.Info(msg, args...)
+	}
+}
+
+func (tee teeLogger) Warn(msg string, args ...any) {
+	for _, logger := range tee {
+		logger.Warn(msg, args...)
+	}
+}
+
+func (tee teeLogger) Error(msg string, args ...any) {
+	for _, logger := range tee {
+		logger.Error(msg, args...)
+	}
+}
+
+// DefaultLogLines LogBuffer 默认保留条数
+const DefaultLogLines = 200
+
+// LogEntry 日志记录
+type LogEntry struct {
+	Time    time.Time      `json:"time"`
+	Level   string         `json:"level"`
+	Message string         `json:"msg"`
+	Attrs   map[string]any `json:"attrs,omitempty"`
+}
+
+// LogBuffer 保留最近日志的 Logger(包含 Debug)
+type LogBuffer struct {
+	mu      sync.Mutex
+	size    int
+	entries []LogEntry
+	next    int
+}
+
+// NewLogBuffer 创建日志缓存, size 小于等于0 时为 DefaultLogLines
+func NewLogBuffer(size int) *LogBuffer {
+	if size <= 0 {
+		size = DefaultLogLines
+	}
+	return &LogBuffer{size: size}
+}
+
+func (lb *LogBuffer) add(level, msg string, args []any) {
+	entry := LogEntry{Time: time.Now(), Level: level, Message: msg}
+	if len(args) > 0 {
+		entry.Attrs = make(map[string]any, len(args)/2)
+		for i := 0; i < len(args); i += 2 {
+			if i+1 >= len(args) {
+				entry.Attrs["!BADKEY"] = args[i]
+				break
+			}
+			value := args[i+1]
+			switch v := value.(type) {
+			case error:
+				value = v.Error()
+			case fmt.Stringer:
+				value = v.String()
+			}
+			entry.Attrs[fmt.Sprint(args[i])] = value
+		}
+	}
+	lb.mu.Lock()
+	if len(lb.entries) < lb.size {
+		lb.entries = append(lb.entries, entry)
+	} else {
+		lb.entries[lb.next] = entry
+		lb.next = (lb.next + 1) % lb.size
+	}
+	lb.mu.Unlock()
+}
+
+// Entries 按时间顺序返回最近 limit 条日志, limit 小于等于0 返回全部
+func (lb *LogBuffer) Entries(limit int) []LogEntry {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	entries := make([]LogEntry, 0, len(lb.entries))
+	entries = append(entries, lb.entries[lb.next:]...)
+	entries = append(entries, lb.entries[:lb.next]...)
+	if limit > 0 && limit < len(entries) {
+		entries = entries[len(entries)-limit:]
+	}
+	return entries
+}
+
+// Debug 调试日志
+func (lb *LogBuffer) Debug(msg string, args ...any) { lb.add("DEBUG", msg, args) }
+
+// Info 信息日志
+func (lb *LogBuffer) Info(msg string, args ...any) { lb.add("INFO", msg, args) }
+
+// Warn 警告日志
+func (lb *LogBuffer) Warn(msg string, args ...any) { lb.add("WARN", msg, args) }
+
+// Error 错误日志
+func (lb *LogBuffer) Error(msg string, args ...any) { lb.add("ERROR", msg, args) }
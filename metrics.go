@@ -0,0 +1,298 @@
+package usbmuxd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultLatencyBuckets 默认耗时分布区间(秒)
+var DefaultLatencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+type metricSeries struct {
+	labels []string
+	value  float64
+	counts []uint64
+	count  uint64
+}
+
+type metricFamily struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*metricSeries
+}
+
+func newMetricFamily(name, help, kind string, buckets []float64, labels ...string) *metricFamily {
+	return &metricFamily{name: name, help: help, kind: kind, labels: labels, buckets: buckets, series: make(map[string]*metricSeries)}
+}
+
+// get 获取(或创建)标签对应的序列, 调用方需持有 mu
+func (family *metricFamily) get(values []string) *metricSeries {
+	if len(values) != len(family.labels) {
+		panic(fmt.Sprintf("metric %s: expected %d label values, got %d", family.name, len(family.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	series, ok := family.series[key]
+	if !ok {
+		series = &metricSeries{labels: append([]string(nil), values...)}
+		if family.kind == "histogram" {
+			series.counts = make([]uint64, len(family.buckets))
+		}
+		family.series[key] = series
+	}
+	return series
+}
+
+func formatLabels(names, values []string, extra ...string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(names)+len(extra)/2)
+	for i, name := range names {
+		pairs = append(pairs, name+"="+strconv.Quote(values[i]))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+"="+strconv.Quote(extra[i+1]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func (family *metricFamily) write(w io.Writer) {
+	family.mu.Lock()
+	defer family.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", family.name, family.help, family.name, family.kind)
+	keys := make([]string, 0, len(family.series))
+	for key := range family.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		series := family.series[key]
+		if family.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", family.name, formatLabels(family.labels, series.labels), formatValue(series.value))
+			continue
+		}
+		var cumulative uint64
+		for i, bound := range family.buckets {
+			cumulative += series.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", family.name, formatLabels(family.labels, series.labels, "le", formatValue(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", family.name, formatLabels(family.labels, series.labels, "le", "+Inf"), series.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", family.name, formatLabels(family.labels, series.labels), formatValue(series.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", family.name, formatLabels(family.labels, series.labels), series.count)
+	}
+}
+
+// CounterVec 计数器
+type CounterVec struct{ family *metricFamily }
+
+// Add 增加计数(nil 时忽略)
+func (vec *CounterVec) Add(value float64, labels ...string) {
+	if vec == nil || value < 0 {
+		return
+	}
+	vec.family.mu.Lock()
+	vec.family.get(labels).value += value
+	vec.family.mu.Unlock()
+}
+
+// Inc 计数加一
+func (vec *CounterVec) Inc(labels ...string) {
+	vec.Add(1, labels...)
+}
+
+// GaugeVec 仪表
+type GaugeVec struct{ family *metricFamily }
+
+// Add 增减数值(nil 时忽略)
+func (vec *GaugeVec) Add(value float64, labels ...string) {
+	if vec == nil {
+		return
+	}
+	vec.family.mu.Lock()
+	vec.family.get(labels).value += value
+	vec.family.mu.Unlock()
+}
+
+// Set 设置数值(nil 时忽略)
+func (vec *GaugeVec) Set(value float64, labels ...string) {
+	if vec == nil {
+		return
+	}
+	vec.family.mu.Lock()
+	vec.family.get(labels).value = value
+	vec.family.mu.Unlock()
+}
+
+// HistogramVec 分布
+type HistogramVec struct{ family *metricFamily }
+
+// Observe 记录一个值(nil 时忽略)
+func (vec *HistogramVec) Observe(value float64, labels ...string) {
+	if vec == nil {
+		return
+	}
+	vec.family.mu.Lock()
+	series := vec.family.get(labels)
+	for i, bound := range vec.family.buckets {
+		if value <= bound {
+			series.counts[i]++
+			break
+		}
+	}
+	series.value += value
+	series.count++
+	vec.family.mu.Unlock()
+}
+
+// Since 记录从 start 开始的耗时(秒)
+func (vec *HistogramVec) Since(start time.Time, labels ...string) {
+	vec.Observe(time.Since(start).Seconds(), labels...)
+}
+
+// Metrics 运行指标, 以 Prometheus 文本格式输出; nil 时所有记录为空操作
+type Metrics struct {
+	DevicesAttached  *GaugeVec     // 已连接设备数(connection_type, product)
+	ConnectAttempts  *CounterVec   // Connect 次数
+	ConnectFailures  *CounterVec   // Connect 失败次数(result)
+	BytesForwarded   *CounterVec   // 经 Connect 连接转发的字节数(port, direction)
+	SSHOperationTime *HistogramVec // SSH/SFTP 操作耗时(op)
+	ControlerDevices *GaugeVec     // DeviceControler 正在处理的设备数
+	JobsTotal        *CounterVec   // DeviceControler 任务结果(action, outcome)
+	families         []*metricFamily
+	familiesLock     sync.Mutex
+}
+
+// NewMetrics 创建指标
+func NewMetrics() *Metrics {
+	metrics := &Metrics{}
+	metrics.DevicesAttached = metrics.Gauge("usbmuxd_devices_attached", "Number of devices currently attached to usbmuxd.", "connection_type", "product")
+	metrics.ConnectAttempts = metrics.Counter("usbmuxd_connect_attempts_total", "Number of usbmuxd Connect requests.")
+	metrics.ConnectFailures = metrics.Counter("usbmuxd_connect_failures_total", "Number of failed usbmuxd Connect requests by result.", "result")
+	metrics.BytesForwarded = metrics.Counter("usbmuxd_forwarded_bytes_total", "Bytes transferred over usbmuxd device connections.", "port", "direction")
+	metrics.SSHOperationTime = metrics.Histogram("usbmuxd_ssh_operation_seconds", "Latency of SSH and SFTP operations.", DefaultLatencyBuckets, "op")
+	metrics.ControlerDevices = metrics.Gauge("usbmuxd_controler_devices", "Number of devices handled by DeviceControler.")
+	metrics.JobsTotal = metrics.Counter("usbmuxd_jobs_total", "DeviceControler job outcomes.", "action", "outcome")
+	return metrics
+}
+
+func (metrics *Metrics) register(family *metricFamily) *metricFamily {
+	metrics.familiesLock.Lock()
+	metrics.families = append(metrics.families, family)
+	metrics.familiesLock.Unlock()
+	return family
+}
+
+// Counter 注册计数器
+func (metrics *Metrics) Counter(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{family: metrics.register(newMetricFamily(name, help, "counter", nil, labels...))}
+}
+
+// Gauge 注册仪表
+func (metrics *Metrics) Gauge(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{family: metrics.register(newMetricFamily(name, help, "gauge", nil, labels...))}
+}
+
+// Histogram 注册分布
+func (metrics *Metrics) Histogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{family: metrics.register(newMetricFamily(name, help, "histogram", buckets, labels...))}
+}
+
+// WriteText 以 Prometheus 文本格式输出全部指标
+func (metrics *Metrics) WriteText(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	metrics.familiesLock.Lock()
+	families := append([]*metricFamily(nil), metrics.families...)
+	metrics.familiesLock.Unlock()
+	for _, family := range families {
+		family.write(bw)
+	}
+	return bw.Flush()
+}
+
+// ServeHTTP 提供 /metrics 接口
+func (metrics *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics.WriteText(w)
+}
+
+func (metrics *Metrics) deviceAttached(props *USBDeviceAttachedPropertiesDictFrame, delta float64) {
+	if metrics == nil {
+		return
+	}
+	metrics.DevicesAttached.Add(delta, props.ConnectionType, fmt.Sprintf("%x", props.ProductID))
+}
+
+func (metrics *Metrics) connectResult(err error) {
+	if metrics == nil {
+		return
+	}
+	metrics.ConnectAttempts.Inc()
+	if err == nil {
+		return
+	}
+	result := "error"
+	if resultErr, ok := err.(*ResultError); ok {
+		result = resultErr.Code.String()
+	}
+	metrics.ConnectFailures.Inc(result)
+}
+
+func (metrics *Metrics) sshOperation(op string, start time.Time) {
+	if metrics == nil {
+		return
+	}
+	metrics.SSHOperationTime.Since(start, op)
+}
+
+func (metrics *Metrics) controlerDevices(count int64) {
+	if metrics == nil {
+		return
+	}
+	metrics.ControlerDevices.Set(float64(count))
+}
+
+func (metrics *Metrics) jobOutcome(action string, err error) {
+	if metrics == nil {
+		return
+	}
+	outcome := "success"
+	if err != nil {
+		outcome = "failure"
+	}
+	metrics.JobsTotal.Inc(action, outcome)
+}
+
+// countingConn 统计转发字节数的连接
+type countingConn struct {
+	net.Conn
+	port    string
+	metrics *Metrics
+}
+
+func (conn *countingConn) Read(b []byte) (int, error) {
+	n, err := conn.Conn.Read(b)
+	conn.metrics.BytesForwarded.Add(float64(n), conn.port, "in")
+	return n, err
+}
+
+func (conn *countingConn) Write(b []byte) (int, error) {
+	n, err := conn.Conn.Write(b)
+	conn.metrics.BytesForwarded.Add(float64(n), conn.port, "out")
+	return n, err
+}
@@ -0,0 +1,437 @@
+package usbmuxd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// RootlessPrefix rootless 越狱的根目录
+const RootlessPrefix = "/var/jb"
+
+// PackageStageDir 安装前上传 deb 的目录
+const PackageStageDir = "/var/mobile/usbmuxd-debs"
+
+// 包版本比较结果
+const (
+	PackageMissing = "missing" // 未安装
+	PackageOlder   = "older"   // 已安装版本低于期望版本
+	PackageNewer   = "newer"   // 已安装版本高于期望版本
+	PackageEqual   = "equal"   // 版本一致(或未指定期望版本)
+)
+
+// Package 已安装的包
+type Package struct {
+	Name         string `json:"name"`
+	Version      string `json:"version"`
+	Architecture string `json:"architecture,omitempty"`
+	Status       string `json:"status"` // 如 "install ok installed"
+}
+
+// PackageDiff 已安装版本与期望版本的比较
+type PackageDiff struct {
+	Name      string `json:"name"`
+	Installed string `json:"installed,omitempty"`
+	Desired   string `json:"desired,omitempty"`
+	State     string `json:"state"` // Package* 常量
+}
+
+// DebInfo deb 文件的控制信息
+type DebInfo struct {
+	File       string   `json:"file"`
+	Package    string   `json:"package"`
+	Version    string   `json:"version"`
+	Depends    []string `json:"depends,omitempty"` // Depends 与 Pre-Depends 中的包名
+	remotePath string
+}
+
+// PackageManager 通过 SSH 管理设备上的 dpkg/apt 包
+type PackageManager struct {
+	Root    string      // 越狱根目录, rootless 为 RootlessPrefix, rootful 为空
+	Options *RunOptions // 命令的输出选项(实时输出、前缀), Env 会加入 PATH
+	su      *SSHUtil
+}
+
+// Packages 创建包管理, 检测 rootless 越狱(/var/jb 下的 dpkg)
+func (su *SSHUtil) Packages(ctx context.Context) (*PackageManager, error) {
+	command := "if [ -x " + RootlessPrefix + "/usr/bin/dpkg ]; then echo " + RootlessPrefix + "; fi"
+	result, err := su.Run(ctx, command, &RunOptions{MaxOutput: 4096})
+	if err == nil {
+		err = result.Err()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("detect jailbreak root: %w", err)
+	}
+	pm := &PackageManager{Root: strings.TrimSpace(result.Stdout), su: su}
+	su.logger().Debug("package manager ready", "op", "packages", "root", pm.Root)
+	return pm, nil
+}
+
+// Path 越狱文件系统中的路径, 如 Path("/Library/MobileSubstrate") 在 rootless 下为 /var/jb/Library/MobileSubstrate
+func (pm *PackageManager) Path(p string) string {
+	return path.Join(pm.Root+"/", p)
+}
+
+// AdminDir dpkg 数据目录
+func (pm *PackageManager) AdminDir() string {
+	return pm.Path("/var/lib/dpkg")
+}
+
+// run 以越狱根目录下的 PATH 运行命令, 退出码不为0 时返回错误
+func (pm *PackageManager) run(ctx context.Context, command string, quiet bool) (*RunResult, error) {
+	opts := RunOptions{}
+	if pm.Options != nil {
+		opts = *pm.Options
+	}
+	if quiet {
+		opts.Stdin, opts.Stdout, opts.Stderr, opts.PTY = nil, nil, nil, false
+		opts.MaxOutput = 64 << 20
+	}
+	env := map[string]string{}
+	for name, value := range opts.Env {
+		env[name] = value
+	}
+	var paths []string
+	for _, dir := range []string{"/usr/local/sbin", "/usr/local/bin", "/usr/sbin", "/usr/bin", "/sbin", "/bin"} {
+		if pm.Root != "" {
+			paths = append(paths, pm.Path(dir))
+		}
+		paths = append(paths, dir)
+	}
+	env["PATH"] = strings.Join(paths, ":")
+	env["DEBIAN_FRONTEND"] = "noninteractive"
+	opts.Env = env
+	result, err := pm.su.Run(ctx, command, &opts)
+	if err == nil {
+		err = result.Err()
+	}
+	if err != nil {
+		return result, fmt.Errorf("%w %s", err, strings.TrimSpace(result.Stderr))
+	}
+	return result, nil
+}
+
+// validPackageName 包名只允许小写字母、数字与 + - . (apt 还允许 =版本 与 :架构)
+func validPackageName(name string) bool {
+	if name == "" || name[0] == '-' {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("+-.:=~_", r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// quotePackages 校验并转义包名
+func quotePackages(names []string) (string, error) {
+	if len(names) == 0 {
+		return "", fmt.Errorf("no packages")
+	}
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		if !validPackageName(name) {
+			return "", fmt.Errorf("invalid package name %q", name)
+		}
+		quoted[i] = shellQuote(name)
+	}
+	return strings.Join(quoted, " "), nil
+}
+
+// Installed 已安装的包(按包名排序)
+func (pm *PackageManager) Installed(ctx context.Context) ([]Package, error) {
+	result, err := pm.run(ctx, "dpkg-query -W -f='${Package}\\t${Version}\\t${Architecture}\\t${Status}\\n'", true)
+	if err != nil {
+		return nil, fmt.Errorf("dpkg-query: %w", err)
+	}
+	var packages []Package
+	scanner := bufio.NewScanner(strings.NewReader(result.Stdout))
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) != 4 || !strings.HasSuffix(fields[3], " installed") {
+			continue
+		}
+		packages = append(packages, Package{Name: fields[0], Version: fields[1], Architecture: fields[2], Status: fields[3]})
+	}
+	sort.Slice(packages, func(i, j int) bool { return packages[i].Name < packages[j].Name })
+	return packages, nil
+}
+
+// Compare 比较已安装版本与期望版本(包名 -> 版本, 版本为空只要求已安装), 按包名排序
+func (pm *PackageManager) Compare(ctx context.Context, desired map[string]string) ([]PackageDiff, error) {
+	packages, err := pm.Installed(ctx)
+	if err != nil {
+		return nil, err
+	}
+	installed := make(map[string]string, len(packages))
+	for _, pkg := range packages {
+		installed[pkg.Name] = pkg.Version
+	}
+	diffs := make([]PackageDiff, 0, len(desired))
+	for name, version := range desired {
+		diff := PackageDiff{Name: name, Installed: installed[name], Desired: version}
+		switch cmp := CompareVersions(diff.Installed, version); {
+		case diff.Installed == "":
+			diff.State = PackageMissing
+		case version == "" || cmp == 0:
+			diff.State = PackageEqual
+		case cmp < 0:
+			diff.State = PackageOlder
+		default:
+			diff.State = PackageNewer
+		}
+		diffs = append(diffs, diff)
+	}
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].Name < diffs[j].Name })
+	return diffs, nil
+}
+
+// debInfo 读取已上传 deb 的控制信息
+func (pm *PackageManager) debInfo(ctx context.Context, remotePath string) (*DebInfo, error) {
+	result, err := pm.run(ctx, "dpkg-deb -f "+shellQuote(remotePath)+" Package Version Depends Pre-Depends", true)
+	if err != nil {
+		return nil, fmt.Errorf("dpkg-deb %s: %w", path.Base(remotePath), err)
+	}
+	fields := controlFields(result.Stdout)
+	info := &DebInfo{remotePath: remotePath, Package: fields["Package"], Version: fields["Version"]}
+	info.Depends = append(dependencyNames(fields["Pre-Depends"]), dependencyNames(fields["Depends"])...)
+	if info.Package == "" {
+		return nil, fmt.Errorf("dpkg-deb %s: no package name", path.Base(remotePath))
+	}
+	return info, nil
+}
+
+// controlFields 解析控制信息格式("名称: 值"), 以空白开头的续行合并到上一字段
+func controlFields(text string) map[string]string {
+	fields := make(map[string]string)
+	var last string
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line != "" && (line[0] == ' ' || line[0] == '\t') {
+			if last != "" {
+				fields[last] = strings.TrimSpace(fields[last] + " " + strings.TrimSpace(line))
+			}
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			last = ""
+			continue
+		}
+		last = strings.TrimSpace(name)
+		fields[last] = strings.TrimSpace(value)
+	}
+	return fields
+}
+
+// dependencyNames 依赖字段中的包名, 如 "a (>= 1.0), b | c:arm64" 为 a b c
+func dependencyNames(field string) []string {
+	var names []string
+	for _, group := range strings.Split(field, ",") {
+		for _, alternative := range strings.Split(group, "|") {
+			name := strings.TrimSpace(alternative)
+			if i := strings.IndexAny(name, " (:["); i >= 0 {
+				name = name[:i]
+			}
+			if name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// orderDebs 按依赖排序, 被依赖的包在前; 循环依赖中先访问的包在后(dpkg -i 会统一配置)
+func orderDebs(debs []*DebInfo) []*DebInfo {
+	index := make(map[string]int, len(debs))
+	for i, deb := range debs {
+		index[deb.Package] = i
+	}
+	ordered := make([]*DebInfo, 0, len(debs))
+	state := make([]int, len(debs)) // 0 未访问, 1 访问中, 2 已完成
+	var visit func(i int)
+	visit = func(i int) {
+		if state[i] != 0 {
+			return
+		}
+		state[i] = 1
+		for _, name := range debs[i].Depends {
+			if j, ok := index[name]; ok && j != i {
+				visit(j)
+			}
+		}
+		state[i] = 2
+		ordered = append(ordered, debs[i])
+	}
+	for i := range debs {
+		visit(i)
+	}
+	return ordered
+}
+
+// Install 上传并安装 deb 文件, 按包之间的依赖顺序传给 dpkg -i
+func (pm *PackageManager) Install(ctx context.Context, files ...string) ([]*DebInfo, *RunResult, error) {
+	if len(files) == 0 {
+		return nil, nil, fmt.Errorf("no deb files")
+	}
+	debs := make([]*DebInfo, 0, len(files))
+	for i, file := range files {
+		remotePath := path.Join(PackageStageDir, strconv.Itoa(i)+"-"+filepath.Base(file))
+		if err := pm.su.UploadSFTPContext(ctx, file, remotePath); err != nil {
+			return nil, nil, err
+		}
+		deb, err := pm.debInfo(ctx, remotePath)
+		if err != nil {
+			return nil, nil, err
+		}
+		deb.File = file
+		debs = append(debs, deb)
+	}
+	debs = orderDebs(debs)
+	quoted := make([]string, len(debs))
+	for i, deb := range debs {
+		quoted[i] = shellQuote(deb.remotePath)
+		pm.su.logger().Info("installing package", "op", "packages", "package", deb.Package, "version", deb.Version, "file", deb.File)
+	}
+	result, err := pm.run(ctx, "dpkg -i "+strings.Join(quoted, " "), false)
+	if err != nil {
+		err = fmt.Errorf("dpkg -i: %w", err)
+	}
+	pm.su.Run(ctx, "rm -f -- "+strings.Join(quoted, " "), &RunOptions{MaxOutput: -1})
+	return debs, result, err
+}
+
+// Remove 卸载包, purge 时同时删除配置文件
+func (pm *PackageManager) Remove(ctx context.Context, purge bool, names ...string) (*RunResult, error) {
+	quoted, err := quotePackages(names)
+	if err != nil {
+		return nil, err
+	}
+	flag := "-r"
+	if purge {
+		flag = "-P"
+	}
+	result, err := pm.run(ctx, "dpkg "+flag+" "+quoted, false)
+	if err != nil {
+		err = fmt.Errorf("dpkg %s: %w", flag, err)
+	}
+	return result, err
+}
+
+// AptInstall 通过 apt 从源安装包(可为 包名=版本), 自动解决依赖
+func (pm *PackageManager) AptInstall(ctx context.Context, names ...string) (*RunResult, error) {
+	quoted, err := quotePackages(names)
+	if err != nil {
+		return nil, err
+	}
+	result, err := pm.run(ctx, "apt-get install -y "+quoted, false)
+	if err != nil {
+		err = fmt.Errorf("apt-get install: %w", err)
+	}
+	return result, err
+}
+
+// ClearUpdates 删除 dpkg 未完成的更新记录(updates 目录)
+func (pm *PackageManager) ClearUpdates(ctx context.Context) error {
+	_, err := pm.run(ctx, "rm -rf "+shellQuote(path.Join(pm.AdminDir(), "updates"))+"/*", true)
+	return err
+}
+
+// CompareVersions 按 dpkg 规则比较版本(epoch:upstream-revision), 返回 -1, 0, 1
+func CompareVersions(a, b string) int {
+	epochA, upstreamA, revisionA := splitVersion(a)
+	epochB, upstreamB, revisionB := splitVersion(b)
+	if epochA != epochB {
+		if epochA < epochB {
+			return -1
+		}
+		return 1
+	}
+	if c := compareVersionPart(upstreamA, upstreamB); c != 0 {
+		return c
+	}
+	return compareVersionPart(revisionA, revisionB)
+}
+
+// splitVersion 拆分 epoch、上游版本与修订号
+func splitVersion(version string) (int, string, string) {
+	epoch := 0
+	if i := strings.IndexByte(version, ':'); i >= 0 {
+		epoch, _ = strconv.Atoi(version[:i])
+		version = version[i+1:]
+	}
+	revision := ""
+	if i := strings.LastIndexByte(version, '-'); i >= 0 {
+		version, revision = version[:i], version[i+1:]
+	}
+	return epoch, version, revision
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// versionOrder 非数字字符的排序: ~ 最小, 其次为结束, 字母, 其它字符
+func versionOrder(c byte) int {
+	switch {
+	case isDigit(c):
+		return 0
+	case c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+		return int(c)
+	case c == '~':
+		return -1
+	}
+	return int(c) + 256
+}
+
+// compareVersionPart dpkg 的 verrevcmp: 交替比较非数字段与数字段
+func compareVersionPart(a, b string) int {
+	sign := func(n int) int {
+		if n < 0 {
+			return -1
+		} else if n > 0 {
+			return 1
+		}
+		return 0
+	}
+	for a != "" || b != "" {
+		for a != "" && !isDigit(a[0]) || b != "" && !isDigit(b[0]) {
+			orderA, orderB := 0, 0
+			if a != "" {
+				orderA = versionOrder(a[0])
+			}
+			if b != "" {
+				orderB = versionOrder(b[0])
+			}
+			if orderA != orderB {
+				return sign(orderA - orderB)
+			}
+			a, b = a[1:], b[1:]
+		}
+		a, b = strings.TrimLeft(a, "0"), strings.TrimLeft(b, "0")
+		firstDiff := 0
+		for a != "" && isDigit(a[0]) && b != "" && isDigit(b[0]) {
+			if firstDiff == 0 {
+				firstDiff = int(a[0]) - int(b[0])
+			}
+			a, b = a[1:], b[1:]
+		}
+		if a != "" && isDigit(a[0]) {
+			return 1
+		}
+		if b != "" && isDigit(b[0]) {
+			return -1
+		}
+		if firstDiff != 0 {
+			return sign(firstDiff)
+		}
+	}
+	return 0
+}
@@ -0,0 +1,142 @@
+package usbmuxd
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.0", "1.0", 0},
+		{"1.0", "1.1", -1},
+		{"1.10", "1.9", 1},
+		{"1.01", "1.1", 0},
+		{"1.0", "1.0.0", -1},
+		{"", "0", 0},
+		{"", "", 0},
+		// ~ 排在结束之前
+		{"1.0~beta1", "1.0", -1},
+		{"1.0~beta1", "1.0~beta2", -1},
+		{"1.0~~", "1.0~", -1},
+		{"1.0~", "1.0", -1},
+		// 字母排在非字母之前
+		{"1.0a", "1.0+", -1},
+		{"1.0a", "1.0.", -1},
+		{"1.0a", "1.0", 1},
+		{"1.0+really", "1.0", 1},
+		{"1.0A", "1.0a", -1},
+		// epoch
+		{"1:1.0", "2.0", 1},
+		{"0:2.0", "2.0", 0},
+		{"1:1.0", "2:0.1", -1},
+		// 修订号
+		{"1.0-1", "1.0-2", -1},
+		{"1.0-10", "1.0-9", 1},
+		{"1.0", "1.0-0", 0},
+		{"1.0-1", "1.0", 1},
+		{"1.0-2-1", "1.0-2-0", 1},
+		{"1.0-1~bpo1", "1.0-1", -1},
+		{"2.0-1", "10.0-1", -1},
+	}
+	for _, tt := range tests {
+		if got := CompareVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("CompareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := CompareVersions(tt.b, tt.a); got != -tt.want {
+			t.Errorf("CompareVersions(%q, %q) = %d, want %d", tt.b, tt.a, got, -tt.want)
+		}
+	}
+}
+
+func TestDependencyNames(t *testing.T) {
+	tests := []struct {
+		field string
+		want  []string
+	}{
+		{"", nil},
+		{"a", []string{"a"}},
+		{"a (>= 1.0), b | c:arm64", []string{"a", "b", "c"}},
+		{"firmware (>= 14.0), mobilesubstrate|ellekit", []string{"firmware", "mobilesubstrate", "ellekit"}},
+		{"a [iphoneos-arm64], , b(<<2)", []string{"a", "b"}},
+		{" x ,\ty ", []string{"x", "y"}},
+	}
+	for _, tt := range tests {
+		if got := dependencyNames(tt.field); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("dependencyNames(%q) = %q, want %q", tt.field, got, tt.want)
+		}
+	}
+}
+
+func TestControlFields(t *testing.T) {
+	text := strings.Join([]string{
+		"Package: com.example.tweak",
+		"Version: 1.2-3",
+		"Depends: mobilesubstrate (>= 0.9),",
+		" preferenceloader,",
+		"\tcom.example.lib",
+		"Pre-Depends: dpkg (>= 1.19)",
+		"Description: short",
+		" long line",
+		" .",
+		" more",
+		"garbage",
+		" orphan",
+		"",
+	}, "\n")
+	fields := controlFields(text)
+	want := map[string]string{
+		"Package":     "com.example.tweak",
+		"Version":     "1.2-3",
+		"Depends":     "mobilesubstrate (>= 0.9), preferenceloader, com.example.lib",
+		"Pre-Depends": "dpkg (>= 1.19)",
+		"Description": "short long line . more",
+	}
+	if !reflect.DeepEqual(fields, want) {
+		t.Fatalf("controlFields = %q, want %q", fields, want)
+	}
+	if got := dependencyNames(fields["Depends"]); !reflect.DeepEqual(got, []string{"mobilesubstrate", "preferenceloader", "com.example.lib"}) {
+		t.Fatalf("folded Depends = %q", got)
+	}
+}
+
+func TestOrderDebs(t *testing.T) {
+	deb := func(name string, depends ...string) *DebInfo {
+		return &DebInfo{Package: name, Depends: depends}
+	}
+	names := func(debs []*DebInfo) string {
+		var out []string
+		for _, deb := range debs {
+			out = append(out, deb.Package)
+		}
+		return strings.Join(out, " ")
+	}
+	tests := []struct {
+		name string
+		debs []*DebInfo
+		want string
+	}{
+		{"empty", nil, ""},
+		{"independent keep order", []*DebInfo{deb("a"), deb("b"), deb("c")}, "a b c"},
+		{"chain", []*DebInfo{deb("app", "lib"), deb("lib", "base"), deb("base")}, "base lib app"},
+		{"diamond", []*DebInfo{deb("top", "left", "right"), deb("left", "base"), deb("right", "base"), deb("base")}, "base left right top"},
+		{"missing dependency ignored", []*DebInfo{deb("a", "firmware", "b"), deb("b", "mobilesubstrate")}, "b a"},
+		{"self dependency", []*DebInfo{deb("a", "a"), deb("b")}, "a b"},
+		{"two cycle", []*DebInfo{deb("a", "b"), deb("b", "a")}, "b a"},
+		{"cycle with dependent", []*DebInfo{deb("app", "x"), deb("x", "y"), deb("y", "x", "base"), deb("base")}, "base y x app"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ordered := orderDebs(tt.debs)
+			if got := names(ordered); got != tt.want {
+				t.Fatalf("orderDebs = %q, want %q", got, tt.want)
+			}
+			if len(ordered) != len(tt.debs) {
+				t.Fatalf("orderDebs returned %d packages, want %d", len(ordered), len(tt.debs))
+			}
+		})
+	}
+}
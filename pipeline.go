@@ -0,0 +1,496 @@
+package usbmuxd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// 流水线动作
+const (
+	ActionUpload       = "upload"        // Args: 本地目录, 远程目录, 文件...
+	ActionInstallDEB   = "install_deb"   // Args: deb 路径...(按依赖顺序安装)
+	ActionRemoveDEB    = "remove_deb"    // Args: 包名...
+	ActionCommand      = "command"       // Args: 命令, 标准输入行...
+	ActionInstallApp   = "install_app"   // Args: ipa 路径
+	ActionRunApp       = "run_app"       // Args: BundleID
+	ActionUninstallApp = "uninstall_app" // Args: BundleID
+	ActionReboot       = "reboot"        // 无参数
+)
+
+// ErrStepTimeout 步骤执行超时
+var ErrStepTimeout = errors.New("step timed out")
+
+// StepFunc 自定义步骤
+type StepFunc func(ctx context.Context, job *Job) error
+
+// RetryPolicy 步骤重试策略
+type RetryPolicy struct {
+	Attempts int           // 最多执行次数(含首次), 小于等于1不重试
+	Delay    time.Duration // 重试间隔
+}
+
+// Step 流水线步骤
+type Step struct {
+	Name            string        // 名称, 为空时使用 Action
+	Action          string        // 动作(Action*), Func 不为空时忽略
+	Args            []string      // 动作参数
+	Func            StepFunc      // 自定义动作
+	Timeout         time.Duration // 单次执行超时, 0 为不限制
+	Retry           RetryPolicy   // 失败重试
+	ContinueOnError bool          // 失败后继续执行后续步骤
+	Always          bool          // 不记录完成状态, 每次都执行
+}
+
+// String 步骤名称
+func (step *Step) String() string {
+	if step.Name != "" {
+		return step.Name
+	}
+	if step.Action != "" {
+		return step.Action
+	}
+	return "func"
+}
+
+func (step *Step) actionName() string {
+	if step.Func != nil {
+		return "func"
+	}
+	return step.Action
+}
+
+// Validate 检查步骤参数
+func (step *Step) Validate() error {
+	if step.Func != nil {
+		return nil
+	}
+	need := 0
+	switch step.Action {
+	case ActionUpload:
+		need = 3
+	case ActionInstallDEB, ActionRemoveDEB, ActionCommand, ActionInstallApp, ActionRunApp, ActionUninstallApp:
+		need = 1
+	case ActionReboot:
+	default:
+		return fmt.Errorf("step %s: unknown action %q", step, step.Action)
+	}
+	if len(step.Args) < need {
+		return fmt.Errorf("step %s: action %s needs %d args, got %d", step, step.Action, need, len(step.Args))
+	}
+	return nil
+}
+
+// NeedSSH 步骤是否需要SSH连接
+func (step *Step) NeedSSH() bool {
+	switch step.Action {
+	case ActionUpload, ActionInstallDEB, ActionRemoveDEB, ActionCommand:
+		return step.Func == nil
+	}
+	return false
+}
+
+// JobState 任务状态
+type JobState string
+
+// 任务状态
+const (
+	JobQueued    JobState = "queued"
+	JobRunning   JobState = "running"
+	JobSucceeded JobState = "succeeded"
+	JobFailed    JobState = "failed"
+	JobCanceled  JobState = "canceled" // 设备拔出或 DeviceControler 关闭
+)
+
+// JobRecord 任务执行记录
+type JobRecord struct {
+	ID         int64             `json:"id"`
+	UDID       string            `json:"udid"`
+	Source     string            `json:"source"` // plug: 设备插入时执行; api: 管理接口触发
+	Steps      []string          `json:"steps"`
+	State      JobState          `json:"state"`
+	Step       string            `json:"step,omitempty"` // 当前(或最后执行)的步骤
+	Error      string            `json:"error,omitempty"`
+	Transfer   *TransferProgress `json:"transfer,omitempty"` // 最近一次文件传输进度
+	QueuedAt   time.Time         `json:"queued_at"`
+	StartedAt  time.Time         `json:"started_at,omitempty"`
+	FinishedAt time.Time         `json:"finished_at,omitempty"`
+}
+
+// Done 任务是否已结束
+func (record *JobRecord) Done() bool {
+	return record.State == JobSucceeded || record.State == JobFailed || record.State == JobCanceled
+}
+
+// Job 单台设备上的一次流水线执行, 步骤之间共享SSH连接
+type Job struct {
+	Device    *USBDevice
+	controler *DeviceControler
+	ticket    *PoolTicket
+	record    *JobRecord
+	output    *RunResult
+	mu        sync.Mutex
+	su        *SSHUtil
+	pooled    bool // su 从 SSHPool 借出
+	sftp      bool
+}
+
+// SSH 获取(按需建立)SSH连接, sftp 为 true 时同时连接SFTP
+func (job *Job) SSH(sftp bool) (*SSHUtil, error) {
+	return job.ssh(job.Device.Context(), sftp)
+}
+
+func (job *Job) ssh(ctx context.Context, sftp bool) (*SSHUtil, error) {
+	if pool := job.controler.SSHPool; pool != nil {
+		su, err := pool.Get(ctx, job.Device.UDID, job.newSSH, sftp)
+		if err != nil {
+			return nil, err
+		}
+		// 共享连接, 传输进度等按任务设置
+		su.OnTransfer = job.transferProgress
+		job.mu.Lock()
+		job.su, job.pooled = su, true
+		job.mu.Unlock()
+		return su, nil
+	}
+	job.mu.Lock()
+	su, hasSFTP := job.su, job.sftp
+	job.mu.Unlock()
+	if su == nil {
+		su = job.newSSH()
+		su.OnTransfer = job.transferProgress
+		if err := su.ConnectSSHContext(ctx); err != nil {
+			return nil, fmt.Errorf("connect ssh: %w", err)
+		}
+		job.mu.Lock()
+		job.su = su
+		job.mu.Unlock()
+	}
+	if sftp && !hasSFTP {
+		if err := su.ConnectSFTP(); err != nil {
+			return nil, fmt.Errorf("connect sftp: %w", err)
+		}
+		job.mu.Lock()
+		job.sftp = true
+		job.mu.Unlock()
+	}
+	return su, nil
+}
+
+// newSSH 按控制器配置创建设备的SSH(未连接)
+func (job *Job) newSSH() *SSHUtil {
+	su := job.Device.SSH(job.controler.UserName, job.controler.Password)
+	su.Auth = job.controler.SSHAuth
+	su.KnownHosts = job.controler.KnownHosts
+	su.BandwidthLimit = job.controler.BandwidthLimit
+	su.StrictVerify = job.controler.StrictVerify
+	return su
+}
+
+func (job *Job) transferProgress(progress *TransferProgress) {
+	job.controler.transferProgress(job.Device, job.record, progress)
+}
+
+// Close 关闭SSH连接, 用于中断后重新连接; 使用 SSHPool 时只释放引用, 连接无响应时才从连接池移除
+func (job *Job) Close() {
+	job.mu.Lock()
+	su, pooled := job.su, job.pooled
+	job.su, job.pooled, job.sftp = nil, false, false
+	job.mu.Unlock()
+	if su == nil {
+		return
+	}
+	if pooled {
+		// 连接可能仍被同一设备的其他任务使用
+		job.controler.SSHPool.Verify(job.Device.UDID, su, pooledVerifyTimeout)
+	}
+	su.Close()
+}
+
+// pooledVerifyTimeout 步骤中断后检查共享连接的超时
+const pooledVerifyTimeout = 5 * time.Second
+
+// release 任务结束, 使用 SSHPool 时保留连接供之后的任务复用
+func (job *Job) release() {
+	job.mu.Lock()
+	su := job.su
+	job.su, job.pooled, job.sftp = nil, false, false
+	job.mu.Unlock()
+	if su != nil {
+		su.Close()
+	}
+}
+
+func (job *Job) execute(ctx context.Context, step *Step) error {
+	if step.Func != nil {
+		return step.Func(ctx, job)
+	}
+	device := job.Device
+	switch step.Action {
+	case ActionUpload:
+		su, err := job.ssh(ctx, true)
+		if err != nil {
+			return err
+		}
+		return su.UploadFilesContext(ctx, step.Args[0], step.Args[1], step.Args[2:])
+	case ActionInstallDEB:
+		su, err := job.ssh(ctx, true)
+		if err != nil {
+			return err
+		}
+		output, err := su.installDEB(ctx, step.Args, job.runOptions(nil))
+		job.setOutput(output)
+		return err
+	case ActionRemoveDEB:
+		su, err := job.ssh(ctx, false)
+		if err != nil {
+			return err
+		}
+		pm, err := su.Packages(ctx)
+		if err != nil {
+			return err
+		}
+		pm.Options = job.runOptions(nil)
+		output, err := pm.Remove(ctx, false, step.Args...)
+		job.setOutput(output)
+		return err
+	case ActionCommand:
+		su, err := job.ssh(ctx, false)
+		if err != nil {
+			return err
+		}
+		output, err := su.Run(ctx, step.Args[0], job.runOptions(step.Args[1:]))
+		job.setOutput(output)
+		if err == nil {
+			err = output.Err()
+		}
+		return err
+	case ActionInstallApp:
+		return device.InstallAPPContext(ctx, step.Args[0])
+	case ActionRunApp:
+		return device.RunAppContext(ctx, step.Args[0])
+	case ActionUninstallApp:
+		return device.UninstallAPPContext(ctx, step.Args[0])
+	case ActionReboot:
+		return device.RebootContext(ctx)
+	}
+	return fmt.Errorf("unknown action %q", step.Action)
+}
+
+// runOptions 流水线命令选项: 输出加 UDID 前缀, 保留末尾用于结果
+func (job *Job) runOptions(pipes []string) *RunOptions {
+	return &RunOptions{
+		Stdin:     pipesReader(pipes),
+		MaxOutput: DefaultOutputExcerpt,
+		Stdout:    os.Stdout,
+		Stderr:    os.Stderr,
+		Prefix:    "[" + job.Device.UDID + "] ",
+	}
+}
+
+// setOutput 记录步骤的命令输出
+func (job *Job) setOutput(output *RunResult) {
+	job.mu.Lock()
+	job.output = output
+	job.mu.Unlock()
+}
+
+// runOnce 执行一次步骤, 超时或设备拔出时取消步骤的 ctx
+func (job *Job) runOnce(ctx context.Context, step *Step) error {
+	release, err := job.controler.Pool.AcquireAction(ctx, step.actionName())
+	if err != nil {
+		return context.Cause(ctx)
+	}
+	defer release()
+	stepCtx := ctx
+	if step.Timeout > 0 {
+		var cancel context.CancelFunc
+		stepCtx, cancel = context.WithTimeout(ctx, step.Timeout)
+		defer cancel()
+	}
+	err = job.execute(stepCtx, step)
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+	if stepCtx.Err() != nil {
+		// 中断的SSH连接重新建立(共享连接仍可用时保留)
+		job.Close()
+		return fmt.Errorf("%w after %v", ErrStepTimeout, step.Timeout)
+	}
+	return err
+}
+
+// prepare 检查步骤并替换参数模板
+func (job *Job) prepare(step *Step) (*Step, error) {
+	if err := step.Validate(); err != nil {
+		return nil, err
+	}
+	if step.Func == nil && len(step.Args) > 0 {
+		args, err := expandArgs(step.Args, templateData(job.Device, job.controler.Variables))
+		if err != nil {
+			return nil, fmt.Errorf("step %s: %w", step, err)
+		}
+		expanded := *step
+		expanded.Args = args
+		step = &expanded
+	}
+	return step, nil
+}
+
+// RunStep 执行步骤(含重试)
+func (job *Job) RunStep(step *Step) error {
+	step, err := job.prepare(step)
+	if err != nil {
+		return err
+	}
+	_, err = job.runWithRetry(job.Device.Context(), step)
+	return err
+}
+
+// runWithRetry 执行步骤, 返回执行次数
+func (job *Job) runWithRetry(ctx context.Context, step *Step) (int, error) {
+	attempts := step.Retry.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	logger := job.Device.logger()
+	job.setOutput(nil)
+	var err error
+	attempt := 1
+	for ; attempt <= attempts; attempt++ {
+		if err = job.runOnce(ctx, step); err == nil {
+			return attempt, nil
+		}
+		if ctx.Err() != nil || errors.Is(err, ErrDeviceDisconnected) || errors.Is(err, ErrHostKeyChanged) || attempt == attempts {
+			break
+		}
+		logger.Warn("step failed, retrying", "op", step.String(), "attempt", attempt, "error", err)
+		job.Close()
+		timer := time.NewTimer(step.Retry.Delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return attempt, context.Cause(ctx)
+		}
+	}
+	return attempt, err
+}
+
+// result 生成步骤结果
+func (job *Job) result(step *Step, start time.Time, attempts int, err error) *StepResult {
+	result := &StepResult{
+		UDID:       job.Device.UDID,
+		DeviceID:   job.Device.ID,
+		Step:       step.String(),
+		Action:     step.actionName(),
+		Attempts:   attempts,
+		StartedAt:  start,
+		FinishedAt: time.Now(),
+	}
+	if job.record != nil {
+		result.JobID = job.record.ID
+	}
+	job.mu.Lock()
+	if output := job.output; output != nil && attempts > 0 {
+		if output.ExitCode >= 0 {
+			exitCode := output.ExitCode
+			result.ExitCode = &exitCode
+		}
+		result.Stdout, result.Stderr = output.Stdout, output.Stderr
+	}
+	job.mu.Unlock()
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// publish 发布步骤事件
+func (job *Job) publish(eventType string, step *Step, err error) {
+	event := Event{Type: eventType, UDID: job.Device.UDID, DeviceID: job.Device.ID, Step: step.String()}
+	if job.record != nil {
+		event.JobID = job.record.ID
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	job.controler.Events.Publish(event)
+}
+
+// loadState 读取设备状态, 未设置 StateStore 时返回 nil
+func (job *Job) loadState() *DeviceState {
+	if job.controler.State == nil {
+		return nil
+	}
+	state, err := job.controler.State.Load(job.Device.UDID)
+	if err != nil {
+		job.Device.logger().Warn("load device state failed, running all steps", "op", "state", "error", err)
+		return &DeviceState{UDID: job.Device.UDID}
+	}
+	return state
+}
+
+// Run 依次执行步骤, 返回第一个导致中止的错误
+// 设置了 StateStore 时, 已以相同输入完成的前置步骤会被跳过; 一旦有步骤执行, 其后的步骤都会执行
+// 设备拔出时返回 ErrDeviceDisconnected, DeviceControler 关闭时返回 context.Canceled
+func (job *Job) Run(steps []*Step) error {
+	defer job.release()
+	ctx := job.Device.Context()
+	logger := job.Device.logger()
+	state := job.loadState()
+	resume := state != nil
+	var failed error
+	for i, step := range steps {
+		if ctx.Err() != nil {
+			return context.Cause(ctx)
+		}
+		key := fmt.Sprintf("%d:%s", i, step)
+		job.ticket.SetStep(step.String())
+		job.controler.updateRecord(job.record, func(record *JobRecord) { record.Step = step.String() })
+		prepared, err := job.prepare(step)
+		var checksum string
+		if err == nil && state != nil && !step.Always {
+			checksum, err = stepChecksum(prepared)
+		}
+		if err == nil && resume && checksum != "" && state.Completed(key, checksum) {
+			logger.Info("step skipped, already completed", "op", step.String())
+			result := job.result(step, time.Now(), 0, nil)
+			result.Skipped = true
+			job.controler.reportStep(result)
+			continue
+		}
+		resume = false
+		start := time.Now()
+		attempts := 0
+		if err == nil {
+			logger.Info("step started", "op", step.String())
+			job.publish(EventStepStarted, step, nil)
+			attempts, err = job.runWithRetry(ctx, prepared)
+		}
+		job.controler.Metrics.jobOutcome(step.actionName(), err)
+		job.publish(EventStepFinished, step, err)
+		job.controler.reportStep(job.result(step, start, attempts, err))
+		if err == nil {
+			logger.Info("step finished", "op", step.String(), "duration", time.Since(start))
+			if checksum != "" {
+				state.Complete(key, checksum)
+				if err = job.controler.State.Save(state); err != nil {
+					logger.Warn("save device state failed", "op", "state", "error", err)
+				}
+			}
+			continue
+		}
+		logger.Error("step failed", "op", step.String(), "duration", time.Since(start), "error", err)
+		if !step.ContinueOnError {
+			return fmt.Errorf("step %s: %w", step, err)
+		}
+		if failed == nil {
+			failed = fmt.Errorf("step %s: %w", step, err)
+		}
+	}
+	return failed
+}
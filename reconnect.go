@@ -0,0 +1,84 @@
+package usbmuxd
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// ListenerState 监听连接状态
+type ListenerState int
+
+const (
+	// ListenerConnecting 正在连接 usbmuxd
+	ListenerConnecting ListenerState = iota
+	// ListenerConnected 已连接并开始监听
+	ListenerConnected
+	// ListenerLost 连接断开, 等待重连
+	ListenerLost
+	// ListenerStopped 监听已停止
+	ListenerStopped
+)
+
+// String 状态名称
+func (state ListenerState) String() string {
+	switch state {
+	case ListenerConnecting:
+		return "connecting"
+	case ListenerConnected:
+		return "connected"
+	case ListenerLost:
+		return "lost"
+	case ListenerStopped:
+		return "stopped"
+	default:
+		return "unknown"
+	}
+}
+
+// ReconnectPolicy 重连策略
+type ReconnectPolicy struct {
+	InitialDelay time.Duration // 首次重连前等待
+	MaxDelay     time.Duration // 最长等待
+	Multiplier   float64       // 每次失败后等待时间倍数
+	Jitter       float64       // 随机抖动比例(0-1)
+	MaxAttempts  int           // 连续失败最大次数, 0 为不限制
+}
+
+// DefaultReconnectPolicy 默认重连策略
+var DefaultReconnectPolicy = ReconnectPolicy{
+	InitialDelay: time.Second,
+	MaxDelay:     30 * time.Second,
+	Multiplier:   2,
+	Jitter:       0.2,
+}
+
+// Delay 第 attempt 次(从1开始)重连前的等待时间, MaxDelay 不大于0时最长为 math.MaxInt64
+func (policy *ReconnectPolicy) Delay(attempt int) time.Duration {
+	limit := float64(math.MaxInt64)
+	if policy.MaxDelay > 0 {
+		limit = float64(policy.MaxDelay)
+	}
+	delay := float64(policy.InitialDelay)
+	for i := 1; i < attempt && delay < limit && policy.Multiplier > 1; i++ {
+		delay *= policy.Multiplier
+	}
+	if delay > limit {
+		delay = limit
+	}
+	if policy.Jitter > 0 {
+		delay += delay * policy.Jitter * (2*rand.Float64() - 1)
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	if delay >= float64(math.MaxInt64) {
+		return math.MaxInt64
+	}
+	return time.Duration(delay)
+}
+
+// Exhausted 是否已超过最大重连次数
+func (policy *ReconnectPolicy) Exhausted(attempt int) bool {
+	return policy.MaxAttempts > 0 && attempt > policy.MaxAttempts
+}
@@ -0,0 +1,66 @@
+package usbmuxd
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestReconnectDelay(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  ReconnectPolicy
+		attempt int
+		want    time.Duration
+	}{
+		{"first attempt", ReconnectPolicy{InitialDelay: time.Second, MaxDelay: 30 * time.Second, Multiplier: 2}, 1, time.Second},
+		{"backoff", ReconnectPolicy{InitialDelay: time.Second, MaxDelay: 30 * time.Second, Multiplier: 2}, 4, 8 * time.Second},
+		{"capped", ReconnectPolicy{InitialDelay: time.Second, MaxDelay: 30 * time.Second, Multiplier: 2}, 10, 30 * time.Second},
+		{"no multiplier", ReconnectPolicy{InitialDelay: time.Second, MaxDelay: 30 * time.Second}, 10, time.Second},
+		{"multiplier below one", ReconnectPolicy{InitialDelay: time.Second, Multiplier: 0.5}, 10, time.Second},
+		{"uncapped", ReconnectPolicy{InitialDelay: time.Second, Multiplier: 2}, 6, 32 * time.Second},
+		{"uncapped overflow", ReconnectPolicy{InitialDelay: time.Second, Multiplier: 10}, 100, math.MaxInt64},
+		{"overflow with jitter", ReconnectPolicy{InitialDelay: time.Hour, Multiplier: 1e6, Jitter: 1}, 1000, -1},
+		{"zero", ReconnectPolicy{}, 5, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.policy.Delay(tt.attempt)
+			if tt.want < 0 {
+				if got < 0 {
+					t.Fatalf("Delay(%d) = %v, want non-negative", tt.attempt, got)
+				}
+				return
+			}
+			if got != tt.want {
+				t.Fatalf("Delay(%d) = %v, want %v", tt.attempt, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReconnectDelayJitter(t *testing.T) {
+	policy := ReconnectPolicy{InitialDelay: time.Second, MaxDelay: 4 * time.Second, Multiplier: 2, Jitter: 0.25}
+	for attempt := 1; attempt <= 5; attempt++ {
+		base := policy.InitialDelay << (attempt - 1)
+		if base > policy.MaxDelay {
+			base = policy.MaxDelay
+		}
+		low, high := base-base/4, base+base/4
+		for i := 0; i < 100; i++ {
+			if got := policy.Delay(attempt); got < low || got > high {
+				t.Fatalf("Delay(%d) = %v, want within [%v, %v]", attempt, got, low, high)
+			}
+		}
+	}
+}
+
+func TestReconnectExhausted(t *testing.T) {
+	policy := ReconnectPolicy{MaxAttempts: 3}
+	if policy.Exhausted(3) || !policy.Exhausted(4) {
+		t.Fatal("MaxAttempts 3 should allow 3 attempts")
+	}
+	if (&ReconnectPolicy{}).Exhausted(1 << 20) {
+		t.Fatal("MaxAttempts 0 should never be exhausted")
+	}
+}
@@ -0,0 +1,83 @@
+package usbmuxd
+
+import "fmt"
+
+// ResultCode usbmuxd Result 消息返回码
+type ResultCode int
+
+const (
+	// ResultOK 成功
+	ResultOK ResultCode = 0
+	// ResultBadCommand 无法识别的命令
+	ResultBadCommand ResultCode = 1
+	// ResultBadDevice 设备不存在(已断开)
+	ResultBadDevice ResultCode = 2
+	// ResultConnectionRefused 设备端口拒绝连接
+	ResultConnectionRefused ResultCode = 3
+	// ResultMalformedRequest 设备收到格式错误的请求
+	ResultMalformedRequest ResultCode = 5
+	// ResultBadVersion 协议版本不支持
+	ResultBadVersion ResultCode = 6
+)
+
+// String 返回码名称
+func (code ResultCode) String() string {
+	switch code {
+	case ResultOK:
+		return "ok"
+	case ResultBadCommand:
+		return "bad command"
+	case ResultBadDevice:
+		return "bad device"
+	case ResultConnectionRefused:
+		return "connection refused"
+	case ResultMalformedRequest:
+		return "malformed request"
+	case ResultBadVersion:
+		return "bad version"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(code))
+	}
+}
+
+// ResultError usbmuxd 返回的错误结果
+type ResultError struct {
+	Code     ResultCode
+	DeviceID int
+	Port     int
+}
+
+// Error 错误描述
+func (e *ResultError) Error() string {
+	msg := fmt.Sprintf("usbmuxd result %d (%s)", int(e.Code), e.Code)
+	if e.DeviceID != 0 {
+		msg += fmt.Sprintf(" device %d", e.DeviceID)
+	}
+	if e.Port != 0 {
+		msg += fmt.Sprintf(" port %d", e.Port)
+	}
+	if sentinel := e.Unwrap(); sentinel != nil {
+		msg += ": " + sentinel.Error()
+	}
+	return msg
+}
+
+// Unwrap 对应的哨兵错误, 用于 errors.Is
+func (e *ResultError) Unwrap() error {
+	switch e.Code {
+	case ResultBadDevice:
+		return ErrDeviceDisconnected
+	case ResultConnectionRefused:
+		return ErrDevicePortUnavailable
+	case ResultMalformedRequest:
+		return ErrDevicePortUnknow
+	default:
+		return nil
+	}
+}
+
+// Is 比较错误(同返回码的 ResultError 视为相同)
+func (e *ResultError) Is(target error) bool {
+	t, ok := target.(*ResultError)
+	return ok && t.Code == e.Code && (t.DeviceID == 0 || t.DeviceID == e.DeviceID) && (t.Port == 0 || t.Port == e.Port)
+}
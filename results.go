@@ -0,0 +1,370 @@
+package usbmuxd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultOutputExcerpt 结果中保留的命令输出长度(字节)
+const DefaultOutputExcerpt = 4096
+
+// StepResult 步骤执行结果
+type StepResult struct {
+	UDID       string    `json:"udid"`
+	DeviceID   int       `json:"device_id"`
+	JobID      int64     `json:"job_id,omitempty"`
+	Step       string    `json:"step"`
+	Action     string    `json:"action"`
+	Skipped    bool      `json:"skipped,omitempty"` // 已以相同输入完成, 未执行
+	Attempts   int       `json:"attempts,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	ExitCode   *int      `json:"exit_code,omitempty"` // 命令退出码(command, install_deb, remove_deb)
+	Stdout     string    `json:"stdout,omitempty"`    // 输出末尾, 最多 DefaultOutputExcerpt 字节
+	Stderr     string    `json:"stderr,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// OK 步骤是否成功
+func (result *StepResult) OK() bool {
+	return result.Error == ""
+}
+
+// ResultSummary 控制器运行期间各设备最后一次任务的结果
+type ResultSummary struct {
+	StartedAt  time.Time         `json:"started_at"`
+	FinishedAt time.Time         `json:"finished_at"`
+	Devices    int               `json:"devices"`
+	Succeeded  []string          `json:"succeeded"`
+	Failed     map[string]string `json:"failed"`   // UDID -> 错误
+	Canceled   map[string]string `json:"canceled"` // UDID -> 原因(拔出或关闭)
+}
+
+// OK 至少处理了一台设备且全部成功
+func (summary *ResultSummary) OK() bool {
+	return summary.Devices > 0 && len(summary.Failed) == 0 && len(summary.Canceled) == 0
+}
+
+// ResultSink 结果输出
+type ResultSink interface {
+	ReportStep(result *StepResult) error
+	ReportSummary(summary *ResultSummary) error
+}
+
+// ResultCallback 回调结果输出, 未设置的回调忽略
+type ResultCallback struct {
+	OnStep    func(*StepResult)
+	OnSummary func(*ResultSummary)
+}
+
+// ReportStep 步骤结果
+func (callback *ResultCallback) ReportStep(result *StepResult) error {
+	if callback.OnStep != nil {
+		callback.OnStep(result)
+	}
+	return nil
+}
+
+// ReportSummary 汇总
+func (callback *ResultCallback) ReportSummary(summary *ResultSummary) error {
+	if callback.OnSummary != nil {
+		callback.OnSummary(summary)
+	}
+	return nil
+}
+
+// resultMessage JSON-lines 与 webhook 的消息格式
+type resultMessage struct {
+	Type    string         `json:"type"` // step 或 summary
+	Result  *StepResult    `json:"result,omitempty"`
+	Summary *ResultSummary `json:"summary,omitempty"`
+}
+
+// JSONLinesSink 以 JSON-lines 追加写入文件, 每行一条 resultMessage
+type JSONLinesSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewJSONLinesSink 打开(追加)结果文件
+func NewJSONLinesSink(filePath string) (*JSONLinesSink, error) {
+	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &JSONLinesSink{file: file}, nil
+}
+
+func (sink *JSONLinesSink) write(message *resultMessage) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if sink.file == nil {
+		return os.ErrClosed
+	}
+	_, err = sink.file.Write(append(data, '\n'))
+	return err
+}
+
+// ReportStep 步骤结果
+func (sink *JSONLinesSink) ReportStep(result *StepResult) error {
+	return sink.write(&resultMessage{Type: "step", Result: result})
+}
+
+// ReportSummary 汇总
+func (sink *JSONLinesSink) ReportSummary(summary *ResultSummary) error {
+	return sink.write(&resultMessage{Type: "summary", Summary: summary})
+}
+
+// Close 关闭文件
+func (sink *JSONLinesSink) Close() error {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if sink.file == nil {
+		return nil
+	}
+	err := sink.file.Close()
+	sink.file = nil
+	return err
+}
+
+// DefaultWebhookQueue WebhookSink 默认的待发送队列长度
+const DefaultWebhookQueue = 256
+
+// ErrWebhookQueueFull webhook 待发送队列已满, 步骤结果被丢弃
+var ErrWebhookQueueFull = errors.New("webhook queue full")
+
+// WebhookSink 以 POST JSON(resultMessage) 发送结果
+// 结果进入队列后由后台协程按顺序发送, 不阻塞步骤执行; Close 时等待队列中的结果发送完成
+type WebhookSink struct {
+	URL          string
+	Header       http.Header
+	Client       *http.Client  // nil 为 http.DefaultClient
+	Timeout      time.Duration // 单次请求超时, 0 为 10 秒
+	QueueSize    int           // 待发送的最大条数, 0 为 DefaultWebhookQueue; 队列满时丢弃步骤结果
+	FlushTimeout time.Duration // Close 等待发送完成的时间, 0 为 30 秒
+
+	mu      sync.Mutex
+	queue   chan *resultMessage
+	done    chan struct{}
+	ctx     context.Context
+	cancel  context.CancelFunc
+	closed  bool
+	dropped int64
+	failed  int64
+	errMu   sync.Mutex
+	lastErr error
+}
+
+// start 首次发送时启动发送协程, 调用方持有 mu
+func (sink *WebhookSink) start() {
+	if sink.queue != nil {
+		return
+	}
+	size := sink.QueueSize
+	if size <= 0 {
+		size = DefaultWebhookQueue
+	}
+	sink.queue = make(chan *resultMessage, size)
+	sink.done = make(chan struct{})
+	sink.ctx, sink.cancel = context.WithCancel(context.Background())
+	go sink.send(sink.queue, sink.done)
+}
+
+// send 发送队列中的结果, 直到队列关闭
+func (sink *WebhookSink) send(queue <-chan *resultMessage, done chan struct{}) {
+	defer close(done)
+	for message := range queue {
+		if err := sink.post(message); err != nil {
+			atomic.AddInt64(&sink.failed, 1)
+			sink.errMu.Lock()
+			sink.lastErr = err
+			sink.errMu.Unlock()
+		}
+	}
+}
+
+// enqueue 加入发送队列; wait 为 false 时队列满则丢弃
+func (sink *WebhookSink) enqueue(message *resultMessage, wait bool) error {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if sink.closed {
+		return os.ErrClosed
+	}
+	sink.start()
+	if wait {
+		sink.queue <- message
+		return nil
+	}
+	select {
+	case sink.queue <- message:
+		return nil
+	default:
+		dropped := atomic.AddInt64(&sink.dropped, 1)
+		return fmt.Errorf("%w: %s, %d results dropped", ErrWebhookQueueFull, sink.URL, dropped)
+	}
+}
+
+func (sink *WebhookSink) post(message *resultMessage) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	timeout := sink.Timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(sink.ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sink.URL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	for key, values := range sink.Header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := sink.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook %s: %s", sink.URL, resp.Status)
+	}
+	return nil
+}
+
+// ReportStep 步骤结果, 队列满时丢弃并返回 ErrWebhookQueueFull
+func (sink *WebhookSink) ReportStep(result *StepResult) error {
+	return sink.enqueue(&resultMessage{Type: "step", Result: result}, false)
+}
+
+// ReportSummary 汇总, 队列满时等待
+func (sink *WebhookSink) ReportSummary(summary *ResultSummary) error {
+	return sink.enqueue(&resultMessage{Type: "summary", Summary: summary}, true)
+}
+
+// Dropped 队列满时丢弃的结果数
+func (sink *WebhookSink) Dropped() int64 {
+	return atomic.LoadInt64(&sink.dropped)
+}
+
+// Close 停止接收结果, 等待队列中的结果发送完成(最长 FlushTimeout, 之后中止未完成的发送)
+// 有结果发送失败或被丢弃时返回错误
+func (sink *WebhookSink) Close() error {
+	sink.mu.Lock()
+	if sink.closed || sink.queue == nil {
+		sink.closed = true
+		sink.mu.Unlock()
+		return nil
+	}
+	sink.closed = true
+	close(sink.queue)
+	sink.mu.Unlock()
+	timeout := sink.FlushTimeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-sink.done:
+	case <-timer.C:
+		sink.cancel()
+		<-sink.done
+	}
+	sink.cancel()
+	failed, dropped := atomic.LoadInt64(&sink.failed), atomic.LoadInt64(&sink.dropped)
+	if failed == 0 && dropped == 0 {
+		return nil
+	}
+	sink.errMu.Lock()
+	err := sink.lastErr
+	sink.errMu.Unlock()
+	if err == nil {
+		err = ErrWebhookQueueFull
+	}
+	return fmt.Errorf("webhook %s: %d results failed, %d dropped: %w", sink.URL, failed, dropped, err)
+}
+
+// deviceOutcome 设备最后一次任务结果
+type deviceOutcome struct {
+	state JobState
+	err   string
+}
+
+// reportStep 将步骤结果发送到所有 Results
+func (controler *DeviceControler) reportStep(result *StepResult) {
+	for _, sink := range controler.Results {
+		if err := sink.ReportStep(result); err != nil {
+			controler.logger().Warn("report step result failed", "op", "results", "udid", result.UDID, "error", err)
+		}
+	}
+}
+
+// Summary 各设备最后一次任务的结果汇总
+func (controler *DeviceControler) Summary() *ResultSummary {
+	controler.recordMu.Lock()
+	defer controler.recordMu.Unlock()
+	summary := &ResultSummary{
+		StartedAt:  controler.startedAt,
+		FinishedAt: time.Now(),
+		Devices:    len(controler.outcomes),
+		Succeeded:  []string{},
+		Failed:     map[string]string{},
+		Canceled:   map[string]string{},
+	}
+	for udid, outcome := range controler.outcomes {
+		switch outcome.state {
+		case JobSucceeded:
+			summary.Succeeded = append(summary.Succeeded, udid)
+		case JobFailed:
+			summary.Failed[udid] = outcome.err
+		default:
+			summary.Canceled[udid] = outcome.err
+		}
+	}
+	sort.Strings(summary.Succeeded)
+	return summary
+}
+
+// reportSummary 输出汇总并关闭实现 io.Closer 的 Results
+func (controler *DeviceControler) reportSummary() *ResultSummary {
+	summary := controler.Summary()
+	logger := controler.logger()
+	if summary.OK() {
+		logger.Info("run summary", "op", "results", "devices", summary.Devices, "succeeded", len(summary.Succeeded))
+	} else {
+		logger.Warn("run summary", "op", "results", "devices", summary.Devices, "succeeded", len(summary.Succeeded), "failed", len(summary.Failed), "canceled", len(summary.Canceled))
+	}
+	for _, sink := range controler.Results {
+		if err := sink.ReportSummary(summary); err != nil {
+			logger.Warn("report summary failed", "op", "results", "error", err)
+		}
+		if closer, ok := sink.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				logger.Warn("close result sink failed", "op", "results", "error", err)
+			}
+		}
+	}
+	return summary
+}
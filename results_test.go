@@ -0,0 +1,142 @@
+package usbmuxd
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookServer 记录收到的消息, 读取请求后等待 gate(为 nil 时不等待)
+func webhookServer(t *testing.T, gate chan struct{}) (*httptest.Server, func() []resultMessage) {
+	var mu sync.Mutex
+	var received []resultMessage
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var message resultMessage
+		if err := json.NewDecoder(r.Body).Decode(&message); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if gate != nil {
+			select {
+			case <-gate:
+			case <-r.Context().Done():
+				return
+			}
+		}
+		mu.Lock()
+		received = append(received, message)
+		mu.Unlock()
+	}))
+	t.Cleanup(server.Close)
+	return server, func() []resultMessage {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]resultMessage(nil), received...)
+	}
+}
+
+func TestWebhookSinkFlush(t *testing.T) {
+	server, received := webhookServer(t, nil)
+	sink := &WebhookSink{URL: server.URL}
+	for _, step := range []string{"a", "b", "c"} {
+		if err := sink.ReportStep(&StepResult{UDID: "x", Step: step}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sink.ReportSummary(&ResultSummary{Devices: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	messages := received()
+	if len(messages) != 4 {
+		t.Fatalf("received %d messages, want 4", len(messages))
+	}
+	for i, step := range []string{"a", "b", "c"} {
+		if messages[i].Type != "step" || messages[i].Result.Step != step {
+			t.Fatalf("message %d = %+v, want step %s", i, messages[i], step)
+		}
+	}
+	if messages[3].Type != "summary" || messages[3].Summary.Devices != 1 {
+		t.Fatalf("last message = %+v, want summary", messages[3])
+	}
+	if err := sink.ReportStep(&StepResult{}); !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("ReportStep after Close = %v, want %v", err, os.ErrClosed)
+	}
+}
+
+func TestWebhookSinkOverflow(t *testing.T) {
+	gate := make(chan struct{})
+	server, received := webhookServer(t, gate)
+	sink := &WebhookSink{URL: server.URL, QueueSize: 2}
+	// 第一条由发送协程取出后阻塞在请求中, 之后队列容纳 2 条
+	sink.ReportStep(&StepResult{Step: "0"})
+	deadline := time.Now().Add(5 * time.Second)
+	for len(sink.queue) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("sender did not pick up the first result")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	start := time.Now()
+	var dropped int
+	for i := 1; i <= 5; i++ {
+		if err := sink.ReportStep(&StepResult{Step: string(rune('0' + i))}); errors.Is(err, ErrWebhookQueueFull) {
+			dropped++
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("ReportStep blocked for %v", elapsed)
+	}
+	if dropped != 3 || sink.Dropped() != 3 {
+		t.Fatalf("dropped %d (Dropped %d), want 3", dropped, sink.Dropped())
+	}
+	close(gate)
+	err := sink.Close()
+	if !errors.Is(err, ErrWebhookQueueFull) {
+		t.Fatalf("Close error = %v, want %v", err, ErrWebhookQueueFull)
+	}
+	if messages := received(); len(messages) != 3 {
+		t.Fatalf("received %d messages, want 3", len(messages))
+	}
+}
+
+func TestWebhookSinkCloseTimeout(t *testing.T) {
+	server, _ := webhookServer(t, make(chan struct{}))
+	sink := &WebhookSink{URL: server.URL, FlushTimeout: 50 * time.Millisecond}
+	sink.ReportStep(&StepResult{Step: "stuck"})
+	sink.ReportStep(&StepResult{Step: "queued"})
+	start := time.Now()
+	err := sink.Close()
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Close took %v", elapsed)
+	}
+	if err == nil {
+		t.Fatal("Close succeeded with undelivered results")
+	}
+}
+
+func TestWebhookSinkStatusError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	sink := &WebhookSink{URL: server.URL}
+	if err := sink.ReportStep(&StepResult{}); err != nil {
+		t.Fatalf("ReportStep should not wait for delivery: %v", err)
+	}
+	if err := sink.Close(); err == nil {
+		t.Fatal("Close should report the failed delivery")
+	}
+	if err := (&WebhookSink{URL: server.URL}).Close(); err != nil {
+		t.Fatalf("Close of unused sink: %v", err)
+	}
+}
@@ -0,0 +1,322 @@
+package usbmuxd
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// DeviceInfo 设备属性
+type DeviceInfo struct {
+	UDID           string `json:"udid"`
+	DeviceID       int    `json:"device_id"`
+	ProductID      int    `json:"product_id"`
+	ProductType    string `json:"product_type,omitempty"`    // 如 iPhone13,2, 需要 ideviceinfo
+	ProductVersion string `json:"product_version,omitempty"` // iOS 版本, 需要 ideviceinfo
+	ConnectionType string `json:"connection_type"`
+	LocationID     int    `json:"location_id"` // USB 物理位置(hub 端口)
+}
+
+// NewDeviceInfo 从 Attached 消息生成设备属性
+func NewDeviceInfo(frame *USBDeviceAttachedDetachedFrame) *DeviceInfo {
+	return &DeviceInfo{
+		UDID:           frame.Properties.SerialNumber,
+		DeviceID:       frame.DeviceID,
+		ProductID:      frame.Properties.ProductID,
+		ConnectionType: frame.Properties.ConnectionType,
+		LocationID:     frame.Properties.LocationID,
+	}
+}
+
+// LoadLockdown 通过 ideviceinfo 读取 ProductType 与 ProductVersion
+func (info *DeviceInfo) LoadLockdown(ctx context.Context) error {
+	var err error
+	if info.ProductType == "" {
+		if info.ProductType, err = iMobileDeviceInfo(ctx, info.UDID, "ProductType"); err != nil {
+			return err
+		}
+	}
+	if info.ProductVersion == "" {
+		if info.ProductVersion, err = iMobileDeviceInfo(ctx, info.UDID, "ProductVersion"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lockdownRetry 读取设备属性失败时的重试策略, 设备刚插入(lockdown 未就绪或未信任)时 ideviceinfo 会失败
+var lockdownRetry = ReconnectPolicy{InitialDelay: time.Second, MaxDelay: 10 * time.Second, Multiplier: 2, MaxAttempts: 6}
+
+// loadLockdownRetry 读取设备属性, 失败时重试直到成功、次数用尽或 ctx 取消(设备拔出)
+func (info *DeviceInfo) loadLockdownRetry(ctx context.Context, logger Logger) error {
+	for attempt := 1; ; attempt++ {
+		err := info.LoadLockdown(ctx)
+		if err == nil || ctx.Err() != nil || lockdownRetry.Exhausted(attempt) {
+			return err
+		}
+		logger.Debug("read device info failed, retrying", "op", "plug", "udid", info.UDID, "attempt", attempt, "error", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(lockdownRetry.Delay(attempt)):
+		}
+	}
+}
+
+// lockdownLookup 插入后在后台读取属性的设备
+type lockdownLookup struct {
+	frame  *USBDeviceAttachedDetachedFrame
+	cancel context.CancelFunc
+}
+
+// lockdownLookups 按设备 ID 记录后台读取, 设备拔出时取消; 方法由调用方加锁
+type lockdownLookups struct {
+	pending map[int]*lockdownLookup
+}
+
+// add 记录设备的读取(取消同 ID 的旧读取), 返回读取使用的 ctx
+func (lookups *lockdownLookups) add(parent context.Context, frame *USBDeviceAttachedDetachedFrame) (*lockdownLookup, context.Context) {
+	if lookups.pending == nil {
+		lookups.pending = make(map[int]*lockdownLookup)
+	}
+	lookups.cancel(frame.DeviceID)
+	ctx, cancel := context.WithCancel(parent)
+	lookup := &lockdownLookup{frame: frame, cancel: cancel}
+	lookups.pending[frame.DeviceID] = lookup
+	return lookup, ctx
+}
+
+// done 读取结束后移除, 返回设备当前的 Attached 消息; 设备已拔出或重新插入时返回 nil
+func (lookups *lockdownLookups) done(lookup *lockdownLookup) *USBDeviceAttachedDetachedFrame {
+	lookup.cancel()
+	if lookups.pending[lookup.frame.DeviceID] != lookup {
+		return nil
+	}
+	delete(lookups.pending, lookup.frame.DeviceID)
+	return lookup.frame
+}
+
+// cancel 设备拔出时取消读取
+func (lookups *lockdownLookups) cancel(id int) {
+	if lookup, ok := lookups.pending[id]; ok {
+		lookup.cancel()
+		delete(lookups.pending, id)
+	}
+}
+
+// reattach usbmuxd 重启后设备 ID 改变, 读取改为以新 ID 记录
+func (lookups *lockdownLookups) reattach(oldID int, frame *USBDeviceAttachedDetachedFrame) {
+	if lookup, ok := lookups.pending[oldID]; ok {
+		delete(lookups.pending, oldID)
+		lookups.cancel(frame.DeviceID)
+		lookup.frame = frame
+		lookups.pending[frame.DeviceID] = lookup
+	}
+}
+
+// 选择器属性
+const (
+	selectUDID       = "udid"
+	selectProduct    = "product"
+	selectType       = "type"
+	selectVersion    = "ios"
+	selectConnection = "conn"
+	selectLocation   = "location"
+)
+
+type selectorTerm struct {
+	key    string
+	op     string
+	values []string
+}
+
+// Selector 设备选择器
+//
+// 表达式由空白分隔的条件组成, 所有条件需同时满足; 条件格式为 key op value,
+// 多个候选值以 | 分隔(满足其一即可), 字符串值支持 * ? 通配.
+//
+//	udid     UDID                       udid=00008030-*|00008101-*
+//	product  USB ProductID(十六进制)     product=12a8
+//	type     ProductType                type=iPhone13,*
+//	ios      iOS 版本, 支持 > >= < <=    ios>=16 ios<17
+//	conn     连接类型                    conn=USB
+//	location LocationID(十六进制)        location=143*
+//
+// op 可为 = != > >= < <=; 不含运算符的条件视为 udid=条件.
+type Selector struct {
+	expr  string
+	terms []selectorTerm
+}
+
+// ParseSelector 解析选择器表达式, 空表达式匹配所有设备
+func ParseSelector(expr string) (*Selector, error) {
+	sel := &Selector{expr: expr}
+	for _, field := range strings.Fields(expr) {
+		term, err := parseSelectorTerm(field)
+		if err != nil {
+			return nil, fmt.Errorf("selector %q: %w", expr, err)
+		}
+		sel.terms = append(sel.terms, term)
+	}
+	return sel, nil
+}
+
+func parseSelectorTerm(field string) (selectorTerm, error) {
+	i := strings.IndexAny(field, "=!<>")
+	if i < 0 {
+		return selectorTerm{key: selectUDID, op: "=", values: strings.Split(field, "|")}, nil
+	}
+	key := strings.ToLower(field[:i])
+	j := i
+	for j < len(field) && strings.ContainsRune("=!<>", rune(field[j])) {
+		j++
+	}
+	op, value := field[i:j], field[j:]
+	switch op {
+	case "=", "!=", ">", ">=", "<", "<=":
+	default:
+		return selectorTerm{}, fmt.Errorf("invalid operator %q", op)
+	}
+	if value == "" {
+		return selectorTerm{}, fmt.Errorf("empty value for %s", key)
+	}
+	values := strings.Split(value, "|")
+	switch key {
+	case selectUDID, selectType, selectConnection, selectProduct, selectLocation:
+		if op != "=" && op != "!=" {
+			return selectorTerm{}, fmt.Errorf("operator %s not supported for %s", op, key)
+		}
+	case selectVersion:
+		for _, v := range values {
+			if op != "=" && op != "!=" && strings.ContainsAny(v, "*?") {
+				return selectorTerm{}, fmt.Errorf("wildcard not allowed in version range %s", v)
+			}
+		}
+	default:
+		return selectorTerm{}, fmt.Errorf("unknown attribute %q", key)
+	}
+	for _, v := range values {
+		if _, err := path.Match(strings.ToLower(v), ""); err != nil {
+			return selectorTerm{}, fmt.Errorf("invalid pattern %q", v)
+		}
+	}
+	return selectorTerm{key: key, op: op, values: values}, nil
+}
+
+// String 表达式
+func (sel *Selector) String() string {
+	if sel == nil {
+		return ""
+	}
+	return sel.expr
+}
+
+// NeedLockdown 是否需要 ideviceinfo 读取的属性
+func (sel *Selector) NeedLockdown() bool {
+	if sel == nil {
+		return false
+	}
+	for _, term := range sel.terms {
+		if term.key == selectType || term.key == selectVersion {
+			return true
+		}
+	}
+	return false
+}
+
+// Match 设备是否满足全部条件(nil 匹配所有设备)
+func (sel *Selector) Match(info *DeviceInfo) bool {
+	if sel == nil {
+		return true
+	}
+	for _, term := range sel.terms {
+		if !term.match(info) {
+			return false
+		}
+	}
+	return true
+}
+
+func (term *selectorTerm) match(info *DeviceInfo) bool {
+	var actual string
+	switch term.key {
+	case selectUDID:
+		actual = info.UDID
+	case selectProduct:
+		actual = strconv.FormatInt(int64(info.ProductID), 16)
+	case selectType:
+		actual = info.ProductType
+	case selectVersion:
+		actual = info.ProductVersion
+	case selectConnection:
+		actual = info.ConnectionType
+	case selectLocation:
+		actual = strconv.FormatInt(int64(info.LocationID), 16)
+	}
+	matched := false
+	for _, value := range term.values {
+		if term.matchValue(actual, value) {
+			matched = true
+			break
+		}
+	}
+	if term.op == "!=" {
+		return !matched
+	}
+	return matched
+}
+
+func (term *selectorTerm) matchValue(actual, value string) bool {
+	if term.key == selectProduct || term.key == selectLocation {
+		value = strings.TrimPrefix(strings.ToLower(value), "0x")
+	}
+	switch term.op {
+	case "=", "!=":
+		if term.key == selectVersion && !strings.ContainsAny(value, "*?") {
+			return actual != "" && compareVersion(actual, value) == 0
+		}
+		matched, _ := path.Match(strings.ToLower(value), strings.ToLower(actual))
+		return matched
+	}
+	if actual == "" {
+		return false
+	}
+	cmp := compareVersion(actual, value)
+	switch term.op {
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	}
+	return false
+}
+
+// compareVersion 比较点分版本号, 缺少的部分按0处理(16 == 16.0.0)
+func compareVersion(a, b string) int {
+	as := strings.Split(strings.TrimFunc(a, unicode.IsSpace), ".")
+	bs := strings.Split(strings.TrimFunc(b, unicode.IsSpace), ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
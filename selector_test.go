@@ -0,0 +1,196 @@
+package usbmuxd
+
+import (
+	"context"
+	"testing"
+)
+
+func TestParseSelectorErrors(t *testing.T) {
+	tests := []string{
+		"ios=>16",
+		"ios<>16",
+		"type>iPhone13,2",
+		"udid<=abc",
+		"product>12a8",
+		"ios>=16.*",
+		"ios<1?",
+		"model=iPhone",
+		"udid=",
+		"udid=[",
+		"type=iPhone|[a-",
+	}
+	for _, expr := range tests {
+		t.Run(expr, func(t *testing.T) {
+			if sel, err := ParseSelector(expr); err == nil {
+				t.Fatalf("ParseSelector(%q) = %+v, want error", expr, sel)
+			}
+		})
+	}
+}
+
+func TestSelectorMatch(t *testing.T) {
+	info := &DeviceInfo{
+		UDID:           "00008030-001A2B3C4D5E6F70",
+		ProductID:      0x12a8,
+		ProductType:    "iPhone13,2",
+		ProductVersion: "16.4.1",
+		ConnectionType: "USB",
+		LocationID:     0x14310000,
+	}
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{"", true},
+		{"00008030-001A2B3C4D5E6F70", true},
+		{"00008030-*", true},
+		{"00008101-*|00008030-*", true},
+		{"00008101-*", false},
+		{"udid=00008030-001a2b3c4d5e6f70", true},
+		{"udid!=00008030-*", false},
+		{"UDID=00008030-*", true},
+		{"product=12a8", true},
+		{"product=0x12A8", true},
+		{"product!=12a8", false},
+		{"type=iPhone13,*", true},
+		{"type=iphone13,2", true},
+		{"type=iPhone14,?", false},
+		{"type!=iPad*", true},
+		{"ios=16.4.1", true},
+		{"ios=16.4.1.0", true},
+		{"ios=16", false},
+		{"ios=16.*", true},
+		{"ios!=15.*|17.*", true},
+		{"ios>16", true},
+		{"ios>16.4.1", false},
+		{"ios>=16.4.1", true},
+		{"ios<17", true},
+		{"ios<=16.4", false},
+		{"ios>=16 ios<17", true},
+		{"ios>=16 ios<16.4", false},
+		{"ios>=17|16.4", true},
+		{"conn=usb", true},
+		{"conn=Network", false},
+		{"location=143*", true},
+		{"location=0x1431*", true},
+		{"location=15*", false},
+		{"type=iPhone13,* ios>=16 location=143*", true},
+		{"type=iPhone13,* ios>=17 location=143*", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			sel, err := ParseSelector(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := sel.Match(info); got != tt.want {
+				t.Fatalf("Match = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectorWithoutLockdown(t *testing.T) {
+	// 未读取到 ideviceinfo 属性时, 版本范围与类型条件不匹配
+	info := &DeviceInfo{UDID: "abc"}
+	for expr, want := range map[string]bool{
+		"ios>=16":      false,
+		"ios<17":       false,
+		"ios=16":       false,
+		"type=iPhone*": false,
+		"type!=iPad*":  true,
+		"abc":          true,
+	} {
+		sel, err := ParseSelector(expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := sel.Match(info); got != want {
+			t.Errorf("%s: Match = %v, want %v", expr, got, want)
+		}
+	}
+	var sel *Selector
+	if !sel.Match(info) || sel.NeedLockdown() || sel.String() != "" {
+		t.Fatal("nil selector should match every device without lockdown")
+	}
+}
+
+func TestSelectorNeedLockdown(t *testing.T) {
+	for expr, want := range map[string]bool{
+		"":                      false,
+		"udid=abc product=12a8": false,
+		"conn=USB location=14*": false,
+		"type=iPhone13,*":       true,
+		"abc ios>=16":           true,
+		"udid=abc type!=iPad*":  true,
+	} {
+		sel, err := ParseSelector(expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := sel.NeedLockdown(); got != want {
+			t.Errorf("%q: NeedLockdown = %v, want %v", expr, got, want)
+		}
+	}
+}
+
+func TestCompareVersion(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"16", "16", 0},
+		{"16", "16.0.0", 0},
+		{"16.0", "16", 0},
+		{"16.4.1", "16.4", 1},
+		{"16.4", "16.4.1", -1},
+		{"9.3", "10.0", -1},
+		{"16.10", "16.9", 1},
+		{"17.0", "16.99.99", 1},
+		{" 16.1 ", "16.1", 0},
+		{"", "0", 0},
+		{"", "1", -1},
+	}
+	for _, tt := range tests {
+		if got := compareVersion(tt.a, tt.b); got != tt.want {
+			t.Errorf("compareVersion(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := compareVersion(tt.b, tt.a); got != -tt.want {
+			t.Errorf("compareVersion(%q, %q) = %d, want %d", tt.b, tt.a, got, -tt.want)
+		}
+	}
+}
+
+func TestLockdownLookups(t *testing.T) {
+	var lookups lockdownLookups
+	frame := &USBDeviceAttachedDetachedFrame{DeviceID: 1}
+
+	// 拔出后读取结束不再插入
+	lookup, ctx := lookups.add(context.Background(), frame)
+	lookups.cancel(1)
+	if ctx.Err() == nil {
+		t.Fatal("cancel did not cancel the lookup")
+	}
+	if lookups.done(lookup) != nil {
+		t.Fatal("done returned a frame for an unplugged device")
+	}
+
+	// 同 ID 重新插入时旧读取失效
+	old, oldCtx := lookups.add(context.Background(), frame)
+	current, _ := lookups.add(context.Background(), frame)
+	if oldCtx.Err() == nil || lookups.done(old) != nil {
+		t.Fatal("replaced lookup should be cancelled and dropped")
+	}
+	if lookups.done(current) != frame {
+		t.Fatal("current lookup should return its frame")
+	}
+
+	// 重连后设备 ID 改变
+	lookup, _ = lookups.add(context.Background(), frame)
+	moved := &USBDeviceAttachedDetachedFrame{DeviceID: 5}
+	lookups.reattach(1, moved)
+	lookups.cancel(1)
+	if lookups.done(lookup) != moved {
+		t.Fatal("reattached lookup should return the new frame")
+	}
+}
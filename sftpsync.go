@@ -0,0 +1,408 @@
+package usbmuxd
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// 同步动作
+const (
+	SyncUpload   = "upload"
+	SyncDownload = "download"
+	SyncSkip     = "skip"   // 内容未变化或不是普通文件
+	SyncDelete   = "delete" // 目标中多余的文件(Delete 选项)
+)
+
+// SyncOptions 目录同步选项
+type SyncOptions struct {
+	Checksum bool // 比较 sha256(远程使用 sha256sum), 否则比较大小与修改时间
+	Delete   bool // 删除目标中源目录不存在的文件与目录
+	DryRun   bool // 只生成报告, 不修改文件
+}
+
+// SyncEntry 同步报告中的一项
+type SyncEntry struct {
+	Path   string `json:"path"` // 相对路径(以 / 分隔)
+	Action string `json:"action"`
+	Size   int64  `json:"size,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// SyncReport 同步报告
+type SyncReport struct {
+	Entries     []SyncEntry `json:"entries"`
+	Transferred int64       `json:"transferred"` // 传输字节数(DryRun 时为将要传输的字节数)
+	DryRun      bool        `json:"dry_run,omitempty"`
+}
+
+// Count 指定动作的数量
+func (report *SyncReport) Count(action string) int {
+	n := 0
+	for _, entry := range report.Entries {
+		if entry.Action == action {
+			n++
+		}
+	}
+	return n
+}
+
+func (report *SyncReport) add(entry SyncEntry) {
+	report.Entries = append(report.Entries, entry)
+	if entry.Action == SyncUpload || entry.Action == SyncDownload {
+		report.Transferred += entry.Size
+	}
+}
+
+// syncFile 同步两端的文件信息
+type syncFile struct {
+	rel  string
+	info os.FileInfo
+}
+
+// getFile 下载文件并保留权限与修改时间
+//
+// 先写入同目录下的临时文件, 完成后重命名, 目标为只读文件或下载中断时不受影响
+func (su *SSHUtil) getFile(ctx context.Context, remotePath, localPath string, info os.FileInfo) error {
+	srcFile, err := su.sftpclient.Open(remotePath)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+	if err = os.MkdirAll(filepath.Dir(localPath), 0o755); err != nil {
+		return err
+	}
+	dstFile, err := os.CreateTemp(filepath.Dir(localPath), "."+filepath.Base(localPath)+".*"+PartialSuffix)
+	if err != nil {
+		return err
+	}
+	tempPath := dstFile.Name()
+	defer os.Remove(tempPath)
+	reader := su.transfer(ctx, srcFile, TransferDownload, localPath, remotePath, info.Size())
+	if _, err = io.Copy(dstFile, reader); err != nil {
+		dstFile.Close()
+		return err
+	}
+	if err = dstFile.Close(); err != nil {
+		return err
+	}
+	reader.report(true)
+	if err = os.Chmod(tempPath, info.Mode().Perm()); err != nil {
+		return err
+	}
+	if err = os.Chtimes(tempPath, info.ModTime(), info.ModTime()); err != nil {
+		return err
+	}
+	if err = os.Rename(tempPath, localPath); err != nil {
+		// Windows 不能替换只读文件
+		if os.Chmod(localPath, 0o600) != nil {
+			return err
+		}
+		return os.Rename(tempPath, localPath)
+	}
+	return nil
+}
+
+// Download 下载文件, 保留权限与修改时间
+func (su *SSHUtil) Download(ctx context.Context, remotePath, localPath string) error {
+	info, err := su.sftpclient.Stat(remotePath)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s: not a regular file", remotePath)
+	}
+	su.logger().Debug("downloading file", "op", "sftp_download", "remote", remotePath, "local", localPath)
+	return su.getFile(ctx, remotePath, localPath, info)
+}
+
+// localTree 本地目录下的文件与目录(相对路径以 / 分隔), 目录不存在时返回空
+func localTree(root string) (files, dirs []syncFile, others []string, err error) {
+	err = filepath.WalkDir(root, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if filePath == root && errors.Is(err, fs.ErrNotExist) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		rel, err := filepath.Rel(root, filePath)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case info.IsDir():
+			dirs = append(dirs, syncFile{rel: rel, info: info})
+		case info.Mode().IsRegular():
+			files = append(files, syncFile{rel: rel, info: info})
+		default:
+			others = append(others, rel)
+		}
+		return nil
+	})
+	return files, dirs, others, err
+}
+
+// remoteTree 远程目录下的文件与目录, 目录不存在时返回空
+func (su *SSHUtil) remoteTree(root string) (files, dirs []syncFile, others []string, err error) {
+	walker := su.sftpclient.Walk(root)
+	for walker.Step() {
+		if err = walker.Err(); err != nil {
+			if walker.Path() == root && errors.Is(err, os.ErrNotExist) {
+				return nil, nil, nil, nil
+			}
+			return nil, nil, nil, err
+		}
+		rel := strings.TrimPrefix(strings.TrimPrefix(walker.Path(), root), "/")
+		if rel == "" {
+			continue
+		}
+		info := walker.Stat()
+		switch {
+		case info.IsDir():
+			dirs = append(dirs, syncFile{rel: rel, info: info})
+		case info.Mode().IsRegular():
+			files = append(files, syncFile{rel: rel, info: info})
+		default:
+			others = append(others, rel)
+		}
+	}
+	return files, dirs, others, nil
+}
+
+// RemoteSHA256 通过 sha256sum 计算远程文件摘要
+func (su *SSHUtil) RemoteSHA256(ctx context.Context, paths ...string) (map[string]string, error) {
+	digests := make(map[string]string, len(paths))
+	for start := 0; start < len(paths); start += 64 {
+		end := start + 64
+		if end > len(paths) {
+			end = len(paths)
+		}
+		quoted := make([]string, 0, end-start)
+		for _, p := range paths[start:end] {
+			quoted = append(quoted, shellQuote(p))
+		}
+		result, err := su.Run(ctx, "sha256sum -- "+strings.Join(quoted, " "), &RunOptions{MaxOutput: 64 << 20})
+		if err == nil {
+			err = result.Err()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("sha256sum: %w %s", err, strings.TrimSpace(result.Stderr))
+		}
+		scanner := bufio.NewScanner(strings.NewReader(result.Stdout))
+		for scanner.Scan() {
+			digest, name, ok := strings.Cut(scanner.Text(), "  ")
+			if ok {
+				digests[name] = digest
+			}
+		}
+	}
+	return digests, nil
+}
+
+// changed 需要传输的文件, 返回原因
+func (su *SSHUtil) changed(ctx context.Context, opts *SyncOptions, pairs [][2]*syncFile, localRoot, remoteRoot string) (map[string]string, error) {
+	reasons := make(map[string]string)
+	var checks []string
+	for _, pair := range pairs {
+		src, dst := pair[0], pair[1]
+		switch {
+		case dst == nil:
+			reasons[src.rel] = "new"
+		case src.info.Size() != dst.info.Size():
+			reasons[src.rel] = "size"
+		case opts.Checksum:
+			checks = append(checks, src.rel)
+		case src.info.ModTime().Unix() != dst.info.ModTime().Unix():
+			reasons[src.rel] = "mtime"
+		}
+	}
+	if len(checks) == 0 {
+		return reasons, nil
+	}
+	remotePaths := make([]string, len(checks))
+	for i, rel := range checks {
+		remotePaths[i] = path.Join(remoteRoot, rel)
+	}
+	remoteDigests, err := su.RemoteSHA256(ctx, remotePaths...)
+	if err != nil {
+		return nil, err
+	}
+	for i, rel := range checks {
+		localDigest, err := fileDigest(filepath.Join(localRoot, filepath.FromSlash(rel)))
+		if err != nil {
+			return nil, err
+		}
+		if remoteDigests[remotePaths[i]] != localDigest {
+			reasons[rel] = "checksum"
+		}
+	}
+	return reasons, nil
+}
+
+// pairFiles 按相对路径配对源与目标文件
+func pairFiles(src, dst []syncFile) [][2]*syncFile {
+	index := make(map[string]*syncFile, len(dst))
+	for i := range dst {
+		index[dst[i].rel] = &dst[i]
+	}
+	pairs := make([][2]*syncFile, len(src))
+	for i := range src {
+		pairs[i] = [2]*syncFile{&src[i], index[src[i].rel]}
+	}
+	return pairs
+}
+
+// extraneous 目标中源不存在的路径, 按深度倒序(先文件后目录)
+func extraneous(srcFiles, srcDirs, dstFiles, dstDirs []syncFile) []syncFile {
+	exists := make(map[string]bool, len(srcFiles)+len(srcDirs))
+	for _, f := range srcFiles {
+		exists[f.rel] = true
+	}
+	for _, d := range srcDirs {
+		exists[d.rel] = true
+	}
+	var extra []syncFile
+	for _, f := range append(append([]syncFile{}, dstFiles...), dstDirs...) {
+		if !exists[f.rel] {
+			extra = append(extra, f)
+		}
+	}
+	sort.SliceStable(extra, func(i, j int) bool {
+		return strings.Count(extra[i].rel, "/") > strings.Count(extra[j].rel, "/") ||
+			(strings.Count(extra[i].rel, "/") == strings.Count(extra[j].rel, "/") && !extra[i].info.IsDir() && extra[j].info.IsDir())
+	})
+	return extra
+}
+
+// UploadDir 递归上传目录, 跳过未变化的文件, 保留权限与修改时间
+func (su *SSHUtil) UploadDir(ctx context.Context, localDir, remoteDir string, opts *SyncOptions) (*SyncReport, error) {
+	if opts == nil {
+		opts = &SyncOptions{}
+	}
+	report := &SyncReport{DryRun: opts.DryRun}
+	srcFiles, srcDirs, others, err := localTree(localDir)
+	if err != nil {
+		return report, err
+	}
+	dstFiles, dstDirs, _, err := su.remoteTree(remoteDir)
+	if err != nil {
+		return report, err
+	}
+	pairs := pairFiles(srcFiles, dstFiles)
+	reasons, err := su.changed(ctx, opts, pairs, localDir, remoteDir)
+	if err != nil {
+		return report, err
+	}
+	for _, rel := range others {
+		report.add(SyncEntry{Path: rel, Action: SyncSkip, Reason: "not a regular file"})
+	}
+	if !opts.DryRun {
+		for _, d := range srcDirs {
+			if err = su.sftpclient.MkdirAll(path.Join(remoteDir, d.rel)); err != nil {
+				return report, err
+			}
+		}
+	}
+	for _, pair := range pairs {
+		src := pair[0]
+		reason, ok := reasons[src.rel]
+		if !ok {
+			report.add(SyncEntry{Path: src.rel, Action: SyncSkip, Size: src.info.Size(), Reason: "unchanged"})
+			continue
+		}
+		if !opts.DryRun {
+			su.logger().Debug("uploading file", "op", "sftp_upload", "path", src.rel, "reason", reason)
+			if err = su.putFile(ctx, filepath.Join(localDir, filepath.FromSlash(src.rel)), path.Join(remoteDir, src.rel), src.info); err != nil {
+				return report, fmt.Errorf("upload %s: %w", src.rel, err)
+			}
+		}
+		report.add(SyncEntry{Path: src.rel, Action: SyncUpload, Size: src.info.Size(), Reason: reason})
+	}
+	if opts.Delete {
+		for _, extra := range extraneous(srcFiles, srcDirs, dstFiles, dstDirs) {
+			if !opts.DryRun {
+				remotePath := path.Join(remoteDir, extra.rel)
+				if extra.info.IsDir() {
+					err = su.sftpclient.RemoveDirectory(remotePath)
+				} else {
+					err = su.sftpclient.Remove(remotePath)
+				}
+				if err != nil {
+					return report, fmt.Errorf("delete %s: %w", extra.rel, err)
+				}
+			}
+			report.add(SyncEntry{Path: extra.rel, Action: SyncDelete})
+		}
+	}
+	return report, nil
+}
+
+// DownloadDir 递归下载目录, 跳过未变化的文件, 保留权限与修改时间
+func (su *SSHUtil) DownloadDir(ctx context.Context, remoteDir, localDir string, opts *SyncOptions) (*SyncReport, error) {
+	if opts == nil {
+		opts = &SyncOptions{}
+	}
+	report := &SyncReport{DryRun: opts.DryRun}
+	srcFiles, srcDirs, others, err := su.remoteTree(remoteDir)
+	if err != nil {
+		return report, err
+	}
+	dstFiles, dstDirs, _, err := localTree(localDir)
+	if err != nil {
+		return report, err
+	}
+	pairs := pairFiles(srcFiles, dstFiles)
+	reasons, err := su.changed(ctx, opts, pairs, localDir, remoteDir)
+	if err != nil {
+		return report, err
+	}
+	for _, rel := range others {
+		report.add(SyncEntry{Path: rel, Action: SyncSkip, Reason: "not a regular file"})
+	}
+	if !opts.DryRun {
+		for _, d := range srcDirs {
+			if err = os.MkdirAll(filepath.Join(localDir, filepath.FromSlash(d.rel)), 0o755); err != nil {
+				return report, err
+			}
+		}
+	}
+	for _, pair := range pairs {
+		src := pair[0]
+		reason, ok := reasons[src.rel]
+		if !ok {
+			report.add(SyncEntry{Path: src.rel, Action: SyncSkip, Size: src.info.Size(), Reason: "unchanged"})
+			continue
+		}
+		if !opts.DryRun {
+			su.logger().Debug("downloading file", "op", "sftp_download", "path", src.rel, "reason", reason)
+			if err = su.getFile(ctx, path.Join(remoteDir, src.rel), filepath.Join(localDir, filepath.FromSlash(src.rel)), src.info); err != nil {
+				return report, fmt.Errorf("download %s: %w", src.rel, err)
+			}
+		}
+		report.add(SyncEntry{Path: src.rel, Action: SyncDownload, Size: src.info.Size(), Reason: reason})
+	}
+	if opts.Delete {
+		for _, extra := range extraneous(srcFiles, srcDirs, dstFiles, dstDirs) {
+			if !opts.DryRun {
+				if err = os.Remove(filepath.Join(localDir, filepath.FromSlash(extra.rel))); err != nil {
+					return report, fmt.Errorf("delete %s: %w", extra.rel, err)
+				}
+			}
+			report.add(SyncEntry{Path: extra.rel, Action: SyncDelete})
+		}
+	}
+	return report, nil
+}
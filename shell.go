@@ -0,0 +1,193 @@
+package usbmuxd
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// Shell 在设备上打开交互式 shell 并连接本地终端(标准输入为终端时切换为 raw 模式并同步窗口大小)
+// shell 以非0 状态退出时返回 *ssh.ExitError
+func (su *SSHUtil) Shell(ctx context.Context) error {
+	return su.ShellIO(ctx, os.Stdin, os.Stdout, os.Stderr)
+}
+
+// ShellIO 在设备上打开交互式 shell, stdin 为终端(*os.File)时切换为 raw 模式并同步窗口大小
+// stdin 在 shell 退出后可能仍有一次读取未返回
+func (su *SSHUtil) ShellIO(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer) error {
+	if su.sshclient == nil {
+		return errors.New("ssh not connected")
+	}
+	if su.sessions != nil {
+		select {
+		case su.sessions <- struct{}{}:
+			defer func() { <-su.sessions }()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	session, err := su.sshclient.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	fd, isTerminal := -1, false
+	if file, ok := stdin.(*os.File); ok {
+		fd = int(file.Fd())
+		isTerminal = term.IsTerminal(fd)
+	}
+	width, height := 80, 24
+	if isTerminal {
+		if w, h, err := term.GetSize(fd); err == nil {
+			width, height = w, h
+		}
+	}
+	termType := os.Getenv("TERM")
+	if termType == "" {
+		termType = "xterm-256color"
+	}
+	modes := ssh.TerminalModes{ssh.ECHO: 1, ssh.TTY_OP_ISPEED: 14400, ssh.TTY_OP_OSPEED: 14400}
+	if err = session.RequestPty(termType, height, width, modes); err != nil {
+		return err
+	}
+	// 不使用 session.Stdin: Wait 会等待 stdin 读取返回
+	input, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+	session.Stdout, session.Stderr = stdout, stderr
+	if isTerminal {
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			return err
+		}
+		defer term.Restore(fd, state)
+		stopResize := watchResize(fd, func(w, h int) {
+			session.WindowChange(h, w)
+		})
+		defer stopResize()
+	}
+	if err = session.Shell(); err != nil {
+		return err
+	}
+	su.logger().Debug("interactive shell started", "op", "ssh_shell", "term", termType, "cols", width, "rows", height)
+	go func() {
+		io.Copy(input, stdin)
+		input.Close()
+	}()
+	stop := watchContext(ctx, session)
+	err = session.Wait()
+	if ctxErr := stop(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+// deviceWaiter 等待第一台匹配选择器的设备
+type deviceWaiter struct {
+	ctx      context.Context
+	selector *Selector
+	logger   Logger
+	found    chan *USBDevice
+	mu       sync.Mutex
+	devices  map[int]*USBDevice
+	lookups  lockdownLookups
+}
+
+func (waiter *deviceWaiter) USBDeviceDidPlug(frame *USBDeviceAttachedDetachedFrame) {
+	info := NewDeviceInfo(frame)
+	if !waiter.selector.NeedLockdown() {
+		waiter.mu.Lock()
+		defer waiter.mu.Unlock()
+		waiter.plug(frame, info)
+		return
+	}
+	// ideviceinfo 在单独协程中读取并重试, 不阻塞监听协程
+	waiter.mu.Lock()
+	lookup, ctx := waiter.lookups.add(waiter.ctx, frame)
+	waiter.mu.Unlock()
+	go func() {
+		if err := info.loadLockdownRetry(ctx, waiter.logger); err != nil && ctx.Err() == nil {
+			waiter.logger.Warn("read device info failed", "op", "plug", "udid", info.UDID, "device_id", info.DeviceID, "error", err)
+		}
+		waiter.mu.Lock()
+		defer waiter.mu.Unlock()
+		if frame := waiter.lookups.done(lookup); frame != nil && waiter.ctx.Err() == nil {
+			info.DeviceID = frame.DeviceID
+			waiter.plug(frame, info)
+		}
+	}()
+}
+
+// plug 设备满足选择器时通知等待方, 调用方持有 mu
+func (waiter *deviceWaiter) plug(frame *USBDeviceAttachedDetachedFrame, info *DeviceInfo) {
+	if !waiter.selector.Match(info) {
+		return
+	}
+	device := NewUSBDevice(waiter.ctx, frame)
+	device.Info = info
+	device.Logger = waiter.logger
+	waiter.devices[frame.DeviceID] = device
+	select {
+	case waiter.found <- device:
+	default:
+	}
+}
+
+func (waiter *deviceWaiter) USBDeviceDidUnPlug(frame *USBDeviceAttachedDetachedFrame) {
+	waiter.mu.Lock()
+	waiter.lookups.cancel(frame.DeviceID)
+	device, ok := waiter.devices[frame.DeviceID]
+	delete(waiter.devices, frame.DeviceID)
+	waiter.mu.Unlock()
+	if ok {
+		device.Cancel()
+	}
+}
+
+func (waiter *deviceWaiter) USBDidReceiveErrorWhilePluggingOrUnplugging(err error, msg string) {
+	waiter.logger.Error("usbmuxd message error", "op", "listen", "error", err, "message", msg)
+}
+
+// Shell 等待第一台匹配 Target 的设备, 以控制器的认证配置在其上打开交互式 shell
+// 与 Listen 独立使用; shell 以非0 状态退出时返回 *ssh.ExitError, 设备拔出时返回 ErrDeviceDisconnected
+func (controler *DeviceControler) Shell(ctx context.Context) error {
+	selector, err := ParseSelector(controler.Target)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	waiter := &deviceWaiter{ctx: ctx, selector: selector, logger: controler.logger(), found: make(chan *USBDevice, 1), devices: make(map[int]*USBDevice)}
+	listener := &USBListener{Delegate: waiter, Logger: controler.Logger, Metrics: controler.Metrics, CloseDetach: DetachNone}
+	if err = listener.Listen(); err != nil {
+		return err
+	}
+	defer listener.Close()
+	controler.logger().Info("waiting for device", "op", "ssh_shell", "selector", selector.String())
+	var device *USBDevice
+	select {
+	case device = <-waiter.found:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	device.logger().Info("opening shell", "op", "ssh_shell", "product", device.Info.ProductType)
+	su := device.SSH(controler.UserName, controler.Password)
+	su.Auth = controler.SSHAuth
+	su.KnownHosts = controler.KnownHosts
+	if err = su.ConnectSSHContext(device.Context()); err != nil {
+		return err
+	}
+	defer su.Close()
+	err = su.Shell(device.Context())
+	var exitErr *ssh.ExitError
+	if cause := context.Cause(device.Context()); cause != nil && !errors.As(err, &exitErr) {
+		return cause
+	}
+	return err
+}
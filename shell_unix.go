@@ -0,0 +1,35 @@
+//go:build !windows
+// +build !windows
+
+package usbmuxd
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/term"
+)
+
+// watchResize 终端窗口大小变化(SIGWINCH)时回调, 返回的函数停止监视
+func watchResize(fd int, onResize func(width, height int)) func() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGWINCH)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-signals:
+				if width, height, err := term.GetSize(fd); err == nil {
+					onResize(width, height)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
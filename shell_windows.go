@@ -0,0 +1,35 @@
+//go:build windows
+// +build windows
+
+package usbmuxd
+
+import (
+	"time"
+
+	"golang.org/x/term"
+)
+
+// watchResize 定期检查终端窗口大小(Windows 没有 SIGWINCH), 变化时回调, 返回的函数停止监视
+func watchResize(fd int, onResize func(width, height int)) func() {
+	done := make(chan struct{})
+	go func() {
+		lastWidth, lastHeight, _ := term.GetSize(fd)
+		ticker := time.NewTicker(250 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				width, height, err := term.GetSize(fd)
+				if err == nil && (width != lastWidth || height != lastHeight) {
+					lastWidth, lastHeight = width, height
+					onResize(width, height)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
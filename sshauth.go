@@ -0,0 +1,210 @@
+package usbmuxd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// 认证方式
+const (
+	AuthPublicKey           = "publickey"            // KeyFiles 与 Signers
+	AuthAgent               = "agent"                // SSH_AUTH_SOCK 中的密钥
+	AuthKeyboardInteractive = "keyboard-interactive" // 以 Password 回答所有问题
+	AuthPassword            = "password"
+)
+
+// DefaultAuthOrder 默认认证顺序
+var DefaultAuthOrder = []string{AuthPublicKey, AuthAgent, AuthKeyboardInteractive, AuthPassword}
+
+// SSHAuth SSH 认证配置, 可在多台设备间共享
+//
+// publickey 与 agent 的密钥合并为一次 publickey 认证, 按 Order 中的先后尝试
+// (服务端对同一认证方式只接受一次尝试序列).
+type SSHAuth struct {
+	KeyFiles     []string      // 私钥文件
+	Passphrase   string        // 私钥密码
+	Signers      []ssh.Signer  // 内存中的密钥
+	Agent        bool          // 使用 SSH_AUTH_SOCK 中的 ssh-agent
+	Order        []string      // 认证顺序(Auth*), 为空使用 DefaultAuthOrder
+	AuthorizeKey ssh.PublicKey // 密码登录成功后写入 ~/.ssh/authorized_keys, 之后可用密钥登录
+
+	once    sync.Once
+	signers []ssh.Signer
+	err     error
+}
+
+// ParsePrivateKeyFile 读取私钥, 加密的私钥使用 passphrase 解密
+func ParsePrivateKeyFile(filePath, passphrase string) (ssh.Signer, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		if passphrase == "" {
+			return nil, fmt.Errorf("key %s: passphrase required", filePath)
+		}
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(data, []byte(passphrase))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("key %s: %w", filePath, err)
+	}
+	return signer, nil
+}
+
+// keySigners KeyFiles 与 Signers(私钥文件只读取一次)
+func (auth *SSHAuth) keySigners() ([]ssh.Signer, error) {
+	auth.once.Do(func() {
+		for _, keyFile := range auth.KeyFiles {
+			signer, err := ParsePrivateKeyFile(keyFile, auth.Passphrase)
+			if err != nil {
+				auth.err = err
+				return
+			}
+			auth.signers = append(auth.signers, signer)
+		}
+	})
+	if auth.err != nil {
+		return nil, auth.err
+	}
+	return append(append([]ssh.Signer{}, auth.signers...), auth.Signers...), nil
+}
+
+// PublicKey 第一个密钥的公钥, 没有密钥时返回 nil
+func (auth *SSHAuth) PublicKey() (ssh.PublicKey, error) {
+	signers, err := auth.keySigners()
+	if err != nil || len(signers) == 0 {
+		return nil, err
+	}
+	return signers[0].PublicKey(), nil
+}
+
+// sshAuthSession 一次连接的认证方法
+type sshAuthSession struct {
+	methods      []ssh.AuthMethod
+	agentConn    net.Conn
+	usedPassword bool // 尝试过密码类认证(密钥认证失败后)
+}
+
+func (session *sshAuthSession) Close() error {
+	if session.agentConn != nil {
+		return session.agentConn.Close()
+	}
+	return nil
+}
+
+// methods 按顺序生成认证方法; auth 为 nil 时只使用密码
+func (auth *SSHAuth) methods(ctx context.Context, password string, logger Logger) (*sshAuthSession, error) {
+	session := &sshAuthSession{}
+	order := DefaultAuthOrder
+	if auth == nil {
+		order = []string{AuthPassword}
+	} else if len(auth.Order) > 0 {
+		order = auth.Order
+	}
+	var signers []ssh.Signer
+	publicKey := -1
+	for _, name := range order {
+		switch name {
+		case AuthPublicKey:
+			keys, err := auth.keySigners()
+			if err != nil {
+				session.Close()
+				return nil, err
+			}
+			signers = append(signers, keys...)
+		case AuthAgent:
+			if !auth.Agent {
+				continue
+			}
+			sock := os.Getenv("SSH_AUTH_SOCK")
+			if sock == "" {
+				logger.Warn("ssh agent not available", "op", "ssh_auth", "error", "SSH_AUTH_SOCK not set")
+				continue
+			}
+			conn, err := (&net.Dialer{}).DialContext(ctx, "unix", sock)
+			if err != nil {
+				logger.Warn("ssh agent not available", "op", "ssh_auth", "error", err)
+				continue
+			}
+			session.agentConn = conn
+			keys, err := agent.NewClient(conn).Signers()
+			if err != nil {
+				logger.Warn("list ssh agent keys failed", "op", "ssh_auth", "error", err)
+				continue
+			}
+			signers = append(signers, keys...)
+		case AuthKeyboardInteractive:
+			if password == "" {
+				continue
+			}
+			session.methods = append(session.methods, ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+				session.usedPassword = true
+				answers := make([]string, len(questions))
+				for i := range answers {
+					answers[i] = password
+				}
+				return answers, nil
+			}))
+			continue
+		case AuthPassword:
+			if password == "" && auth != nil {
+				continue
+			}
+			session.methods = append(session.methods, ssh.PasswordCallback(func() (string, error) {
+				session.usedPassword = true
+				return password, nil
+			}))
+			continue
+		default:
+			session.Close()
+			return nil, fmt.Errorf("unknown ssh auth method %q", name)
+		}
+		if publicKey < 0 {
+			publicKey = len(session.methods)
+			session.methods = append(session.methods, nil)
+		}
+	}
+	if publicKey >= 0 {
+		if len(signers) > 0 {
+			session.methods[publicKey] = ssh.PublicKeys(signers...)
+		} else {
+			session.methods = append(session.methods[:publicKey], session.methods[publicKey+1:]...)
+		}
+	}
+	if len(session.methods) == 0 {
+		session.Close()
+		return nil, errors.New("no ssh auth method available")
+	}
+	return session, nil
+}
+
+// shellQuote 单引号转义, 用于拼接远程 shell 命令
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// InstallAuthorizedKey 将公钥写入远程 ~/.ssh/authorized_keys(已存在时不重复写入)
+func (su *SSHUtil) InstallAuthorizedKey(ctx context.Context, key ssh.PublicKey) error {
+	line := shellQuote(strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))))
+	command := "mkdir -p ~/.ssh && chmod 700 ~/.ssh && touch ~/.ssh/authorized_keys && chmod 600 ~/.ssh/authorized_keys && " +
+		"(grep -qxF " + line + " ~/.ssh/authorized_keys || echo " + line + " >> ~/.ssh/authorized_keys)"
+	result, err := su.Run(ctx, command, nil)
+	if err == nil {
+		err = result.Err()
+	}
+	if err != nil {
+		return fmt.Errorf("install authorized key: %w %s", err, strings.TrimSpace(result.Stderr))
+	}
+	su.logger().Info("authorized key installed", "op", "ssh_auth", "fingerprint", ssh.FingerprintSHA256(key))
+	return nil
+}
@@ -0,0 +1,274 @@
+package usbmuxd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DefaultKeepAlive SSH keepalive 默认间隔
+const DefaultKeepAlive = 15 * time.Second
+
+// DefaultMaxSessions 每个 SSH 连接默认的最大并发会话数(sshd 的 MaxSessions 默认为 10, 保留1个给 SFTP)
+const DefaultMaxSessions = 8
+
+// KeepAlive 定期发送 keepalive@openssh.com 请求, 连续 maxMissed 次无响应时关闭连接并返回错误; ctx 取消时返回 nil
+func (su *SSHUtil) KeepAlive(ctx context.Context, interval time.Duration, maxMissed int) error {
+	if su.sshclient == nil {
+		return errors.New("ssh not connected")
+	}
+	client := su.sshclient
+	if maxMissed <= 0 {
+		maxMissed = 3
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	missed := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		reply := make(chan error, 1)
+		go func() {
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			reply <- err
+		}()
+		timer := time.NewTimer(interval)
+		select {
+		case err := <-reply:
+			timer.Stop()
+			if err != nil {
+				// 连接已断开
+				return fmt.Errorf("ssh keepalive: %w", err)
+			}
+			missed = 0
+			continue
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		}
+		if missed++; missed >= maxMissed {
+			client.Close()
+			return fmt.Errorf("ssh keepalive: no response after %d attempts", missed)
+		}
+	}
+}
+
+// pooledSSH 连接池中一台设备的连接
+type pooledSSH struct {
+	mu     sync.Mutex // 串行化连接与 SFTP 建立
+	su     *SSHUtil
+	sftp   bool
+	cancel context.CancelFunc
+}
+
+// SSHPool 按设备 UDID 复用 SSH 连接: 发送 keepalive, 连接断开后下次获取时重新连接
+// nil 时 Discard、Remove 与 Close 为空操作.
+//
+// 同一连接上的命令以独立会话并发执行(最多 MaxSessions 个), SFTP 客户端共享.
+type SSHPool struct {
+	KeepAlive   time.Duration // keepalive 间隔, 0 为 DefaultKeepAlive, 小于0 不发送
+	MaxMissed   int           // keepalive 连续无响应次数上限, 0 为 3
+	MaxSessions int           // 每个连接的最大并发会话数, 0 为 DefaultMaxSessions, 小于0 不限制
+
+	mu    sync.Mutex
+	conns map[string]*pooledSSH
+}
+
+// NewSSHPool 创建连接池
+func NewSSHPool(keepAlive time.Duration) *SSHPool {
+	return &SSHPool{KeepAlive: keepAlive, conns: make(map[string]*pooledSSH)}
+}
+
+// entry 设备的连接项(不存在时创建)
+func (pool *SSHPool) entry(udid string) *pooledSSH {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if pool.conns == nil {
+		pool.conns = make(map[string]*pooledSSH)
+	}
+	entry, ok := pool.conns[udid]
+	if !ok {
+		entry = &pooledSSH{}
+		pool.conns[udid] = entry
+	}
+	return entry
+}
+
+// Get 获取设备的共享连接, 未连接或已断开时以 newSSH 创建并连接; sftp 为 true 时同时连接SFTP
+// 返回借出的副本: 可修改其字段(如 OnTransfer), Close 只释放引用不关闭共享连接(关闭使用 Discard)
+func (pool *SSHPool) Get(ctx context.Context, udid string, newSSH func() *SSHUtil, sftp bool) (*SSHUtil, error) {
+	entry := pool.entry(udid)
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	if entry.su == nil {
+		su := newSSH()
+		if pool.MaxSessions >= 0 {
+			sessions := pool.MaxSessions
+			if sessions == 0 {
+				sessions = DefaultMaxSessions
+			}
+			su.sessions = make(chan struct{}, sessions)
+		}
+		if err := su.ConnectSSHContext(ctx); err != nil {
+			return nil, fmt.Errorf("connect ssh: %w", err)
+		}
+		watchCtx, cancel := context.WithCancel(context.Background())
+		entry.su, entry.sftp, entry.cancel = su, false, cancel
+		go pool.watch(watchCtx, udid, su)
+	}
+	if sftp && !entry.sftp {
+		if err := entry.su.ConnectSFTP(); err != nil {
+			return nil, fmt.Errorf("connect sftp: %w", err)
+		}
+		entry.sftp = true
+	}
+	su := *entry.su
+	su.borrowed = true
+	return &su, nil
+}
+
+// watch 连接断开(或 keepalive 失败)时从连接池移除
+func (pool *SSHPool) watch(ctx context.Context, udid string, su *SSHUtil) {
+	client := su.sshclient
+	closed := make(chan error, 1)
+	go func() {
+		closed <- client.Wait()
+	}()
+	keepAlive := pool.KeepAlive
+	if keepAlive == 0 {
+		keepAlive = DefaultKeepAlive
+	}
+	if keepAlive > 0 {
+		go func() {
+			if err := su.KeepAlive(ctx, keepAlive, pool.MaxMissed); err != nil {
+				su.logger().Warn("ssh keepalive failed", "op", "ssh_pool", "udid", udid, "error", err)
+				client.Close()
+			}
+		}()
+	}
+	select {
+	case <-ctx.Done():
+		return
+	case err := <-closed:
+		su.logger().Debug("pooled ssh connection closed", "op", "ssh_pool", "udid", udid, "error", err)
+		pool.Discard(udid, su)
+	}
+}
+
+// Discard 关闭并移除设备的连接(仅当 su 仍为当前连接或其借出的副本时), 下次 Get 重新连接
+// 会中断其他任务在该连接上进行中的操作, 连接未断开时使用 Verify
+func (pool *SSHPool) Discard(udid string, su *SSHUtil) {
+	if pool == nil {
+		return
+	}
+	pool.mu.Lock()
+	entry, ok := pool.conns[udid]
+	pool.mu.Unlock()
+	if !ok {
+		return
+	}
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	if entry.su == nil || entry.su.sshclient != su.sshclient {
+		return
+	}
+	entry.close()
+}
+
+// Verify 检查连接在 timeout 内响应 keepalive, 无响应时 Discard 并返回 false; 用于步骤中断之后
+func (pool *SSHPool) Verify(udid string, su *SSHUtil, timeout time.Duration) bool {
+	if pool == nil || su.sshclient == nil {
+		return false
+	}
+	client := su.sshclient
+	reply := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		reply <- err
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case err = <-reply:
+	case <-timer.C:
+		err = fmt.Errorf("no response in %v", timeout)
+	}
+	if err == nil {
+		return true
+	}
+	su.logger().Warn("pooled ssh connection unresponsive, discarding", "op", "ssh_pool", "udid", udid, "error", err)
+	pool.Discard(udid, su)
+	return false
+}
+
+// close 关闭连接, 调用方需持有 mu
+func (entry *pooledSSH) close() {
+	if entry.su == nil {
+		return
+	}
+	entry.cancel()
+	// 不修改 su 的字段, 仍在使用该连接的调用方会得到连接已关闭的错误
+	if entry.su.sftpclient != nil {
+		entry.su.sftpclient.Close()
+	}
+	entry.su.sshclient.Close()
+	entry.su, entry.sftp, entry.cancel = nil, false, nil
+}
+
+// Remove 关闭并移除设备的连接(设备拔出时)
+func (pool *SSHPool) Remove(udid string) {
+	if pool == nil {
+		return
+	}
+	pool.mu.Lock()
+	entry, ok := pool.conns[udid]
+	delete(pool.conns, udid)
+	pool.mu.Unlock()
+	if ok {
+		entry.mu.Lock()
+		entry.close()
+		entry.mu.Unlock()
+	}
+}
+
+// Close 关闭所有连接
+func (pool *SSHPool) Close() {
+	if pool == nil {
+		return
+	}
+	pool.mu.Lock()
+	udids := make([]string, 0, len(pool.conns))
+	for udid := range pool.conns {
+		udids = append(udids, udid)
+	}
+	pool.mu.Unlock()
+	for _, udid := range udids {
+		pool.Remove(udid)
+	}
+}
+
+// Len 已连接的设备数
+func (pool *SSHPool) Len() int {
+	pool.mu.Lock()
+	entries := make([]*pooledSSH, 0, len(pool.conns))
+	for _, entry := range pool.conns {
+		entries = append(entries, entry)
+	}
+	pool.mu.Unlock()
+	n := 0
+	for _, entry := range entries {
+		entry.mu.Lock()
+		if entry.su != nil {
+			n++
+		}
+		entry.mu.Unlock()
+	}
+	return n
+}
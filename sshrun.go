@@ -0,0 +1,276 @@
+package usbmuxd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultMaxOutput RunResult 默认保留的输出长度(字节)
+const DefaultMaxOutput = 1 << 20
+
+// RunOptions 命令选项
+type RunOptions struct {
+	Stdin     io.Reader         // 标准输入, nil 为空输入
+	Env       map[string]string // 环境变量(以 export 前置到命令, 不依赖 sshd 的 AcceptEnv)
+	PTY       bool              // 分配伪终端(标准错误合并到标准输出)
+	Term      string            // 终端类型, 为空使用 xterm
+	Rows      int               // 终端行数, 0 为 24
+	Cols      int               // 终端列数, 0 为 80
+	MaxOutput int               // 每路输出保留的最后字节数, 0 为 DefaultMaxOutput, 小于0 不保留
+	Stdout    io.Writer         // 同时实时输出标准输出
+	Stderr    io.Writer         // 同时实时输出标准错误
+	Prefix    string            // 实时输出时每行的前缀, 如 "[UDID] "
+}
+
+// RunResult 命令结果
+type RunResult struct {
+	Stdout          string        `json:"stdout"`
+	Stderr          string        `json:"stderr"`
+	StdoutTruncated bool          `json:"stdout_truncated,omitempty"` // 只保留了最后 MaxOutput 字节
+	StderrTruncated bool          `json:"stderr_truncated,omitempty"`
+	ExitCode        int           `json:"exit_code"`        // 退出码, 未能取得时为 -1
+	Signal          string        `json:"signal,omitempty"` // 被信号终止时的信号名(如 KILL)
+	Duration        time.Duration `json:"duration"`
+	exitErr         error
+}
+
+// Err 退出码不为0 或被信号终止时返回 *ssh.ExitError
+func (result *RunResult) Err() error {
+	return result.exitErr
+}
+
+// tailBuffer 只保留最后 limit 字节; 缓冲增长到 2*limit 时一次裁剪, 每字节平均只复制一次
+type tailBuffer struct {
+	limit     int
+	data      []byte
+	truncated bool
+}
+
+func (tb *tailBuffer) Write(p []byte) (int, error) {
+	if tb.limit <= 0 {
+		return len(p), nil
+	}
+	n := len(p)
+	if len(p) >= tb.limit {
+		tb.truncated = tb.truncated || len(tb.data) > 0 || len(p) > tb.limit
+		tb.data = append(tb.data[:0], p[len(p)-tb.limit:]...)
+		return n, nil
+	}
+	if len(tb.data)+len(p) > 2*tb.limit {
+		// 保留的数据与 p 合计 limit 字节
+		keep := tb.limit - len(p)
+		tb.data = append(tb.data[:0], tb.data[len(tb.data)-keep:]...)
+		tb.truncated = true
+	}
+	tb.data = append(tb.data, p...)
+	return n, nil
+}
+
+// Bytes 最后 limit 字节
+func (tb *tailBuffer) Bytes() []byte {
+	if over := len(tb.data) - tb.limit; over > 0 {
+		return tb.data[over:]
+	}
+	return tb.data
+}
+
+// Truncated 是否丢弃了之前的输出
+func (tb *tailBuffer) Truncated() bool {
+	return tb.truncated || len(tb.data) > tb.limit
+}
+
+// PrefixWriter 按行加前缀写入 w, 每行一次 Write; 结束时调用 Flush 写出不完整的最后一行
+type PrefixWriter struct {
+	w      io.Writer
+	prefix string
+	mu     sync.Mutex
+	buf    []byte
+}
+
+// NewPrefixWriter 创建行前缀输出
+func NewPrefixWriter(w io.Writer, prefix string) *PrefixWriter {
+	return &PrefixWriter{w: w, prefix: prefix}
+}
+
+// Write 写入
+func (pw *PrefixWriter) Write(p []byte) (int, error) {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	pw.buf = append(pw.buf, p...)
+	for {
+		i := bytes.IndexByte(pw.buf, '\n')
+		if i < 0 {
+			break
+		}
+		line := make([]byte, 0, len(pw.prefix)+i+1)
+		line = append(append(line, pw.prefix...), pw.buf[:i+1]...)
+		pw.buf = pw.buf[i+1:]
+		if _, err := pw.w.Write(line); err != nil {
+			return len(p), err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush 写出不完整的最后一行
+func (pw *PrefixWriter) Flush() error {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	if len(pw.buf) == 0 {
+		return nil
+	}
+	line := append(append([]byte(pw.prefix), pw.buf...), '\n')
+	pw.buf = nil
+	_, err := pw.w.Write(line)
+	return err
+}
+
+// validEnvName 环境变量名只允许字母、数字与下划线
+func validEnvName(name string) bool {
+	for i, r := range name {
+		if !(r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || i > 0 && r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return name != ""
+}
+
+// envPrefix 生成 export 语句, 按变量名排序
+func envPrefix(env map[string]string) (string, error) {
+	if len(env) == 0 {
+		return "", nil
+	}
+	names := make([]string, 0, len(env))
+	for name := range env {
+		if !validEnvName(name) {
+			return "", fmt.Errorf("invalid env name %q", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var sb strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&sb, "export %s=%s; ", name, shellQuote(env[name]))
+	}
+	return sb.String(), nil
+}
+
+// killSession ctx 取消时先向远端命令发送 SIGKILL 再关闭会话, 只关闭会话时命令可能继续运行
+type killSession struct {
+	*ssh.Session
+}
+
+// Close 结束命令并关闭会话
+func (ks killSession) Close() error {
+	ks.Signal(ssh.SIGKILL)
+	return ks.Session.Close()
+}
+
+// Run 运行命令并返回输出与退出状态, ctx 取消时结束命令并关闭会话
+// 退出码不为0 不作为错误返回, 见 RunResult.Err; 返回的 RunResult 不为 nil
+func (su *SSHUtil) Run(ctx context.Context, command string, opts *RunOptions) (*RunResult, error) {
+	defer su.Metrics.sshOperation("ssh_command", time.Now())
+	start := time.Now()
+	result := &RunResult{ExitCode: -1}
+	if opts == nil {
+		opts = &RunOptions{}
+	}
+	env, err := envPrefix(opts.Env)
+	if err != nil {
+		return result, err
+	}
+	if su.sshclient == nil {
+		return result, errors.New("ssh not connected")
+	}
+	if su.sessions != nil {
+		select {
+		case su.sessions <- struct{}{}:
+			defer func() { <-su.sessions }()
+		case <-ctx.Done():
+			return result, ctx.Err()
+		}
+	}
+	session, err := su.sshclient.NewSession()
+	if err != nil {
+		return result, err
+	}
+	defer session.Close()
+	su.logger().Debug("running command", "op", "ssh_command", "command", command)
+	limit := opts.MaxOutput
+	if limit == 0 {
+		limit = DefaultMaxOutput
+	}
+	stdoutTail, stderrTail := &tailBuffer{limit: limit}, &tailBuffer{limit: limit}
+	var flushers []*PrefixWriter
+	stream := func(tail *tailBuffer, w io.Writer) io.Writer {
+		if w == nil {
+			return tail
+		}
+		if opts.Prefix != "" {
+			pw := NewPrefixWriter(w, opts.Prefix)
+			flushers = append(flushers, pw)
+			w = pw
+		}
+		return io.MultiWriter(tail, w)
+	}
+	session.Stdout = stream(stdoutTail, opts.Stdout)
+	session.Stderr = stream(stderrTail, opts.Stderr)
+	session.Stdin = opts.Stdin
+	if opts.PTY {
+		term, rows, cols := opts.Term, opts.Rows, opts.Cols
+		if term == "" {
+			term = "xterm"
+		}
+		if rows <= 0 {
+			rows = 24
+		}
+		if cols <= 0 {
+			cols = 80
+		}
+		modes := ssh.TerminalModes{ssh.ECHO: 0, ssh.TTY_OP_ISPEED: 14400, ssh.TTY_OP_OSPEED: 14400}
+		if err = session.RequestPty(term, rows, cols, modes); err != nil {
+			return result, fmt.Errorf("request pty: %w", err)
+		}
+	}
+	if err = session.Start(env + command); err != nil {
+		return result, err
+	}
+	stop := watchContext(ctx, killSession{session})
+	err = session.Wait()
+	for _, pw := range flushers {
+		pw.Flush()
+	}
+	result.Duration = time.Since(start)
+	result.Stdout, result.StdoutTruncated = string(stdoutTail.Bytes()), stdoutTail.Truncated()
+	result.Stderr, result.StderrTruncated = string(stderrTail.Bytes()), stderrTail.Truncated()
+	if ctxErr := stop(); ctxErr != nil {
+		return result, ctxErr
+	}
+	var exitErr *ssh.ExitError
+	if err == nil {
+		result.ExitCode = 0
+	} else if errors.As(err, &exitErr) {
+		result.ExitCode = exitErr.ExitStatus()
+		result.Signal = exitErr.Signal()
+		result.exitErr = exitErr
+		err = nil
+	}
+	return result, err
+}
+
+// pipesReader 逐行写入标准输入的内容
+func pipesReader(pipes []string) io.Reader {
+	if len(pipes) == 0 {
+		return nil
+	}
+	return strings.NewReader(strings.Join(pipes, "\n") + "\n")
+}
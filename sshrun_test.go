@@ -0,0 +1,114 @@
+package usbmuxd
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestTailBuffer(t *testing.T) {
+	tests := []struct {
+		name      string
+		limit     int
+		writes    []string
+		want      string
+		truncated bool
+	}{
+		{"empty", 4, nil, "", false},
+		{"below limit", 4, []string{"ab", "c"}, "abc", false},
+		{"at limit", 4, []string{"ab", "cd"}, "abcd", false},
+		{"single write at limit", 4, []string{"abcd"}, "abcd", false},
+		{"one over limit", 4, []string{"abcd", "e"}, "bcde", true},
+		{"single write over limit", 4, []string{"abcde"}, "bcde", true},
+		{"write at limit after data", 4, []string{"a", "bcde"}, "bcde", true},
+		{"twice limit", 4, []string{"abcd", "efgh"}, "efgh", true},
+		{"past twice limit", 4, []string{"abc", "def", "ghi"}, "fghi", true},
+		{"many small writes", 3, []string{"a", "b", "c", "d", "e", "f", "g"}, "efg", true},
+		{"disabled", 0, []string{"abc"}, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tb := &tailBuffer{limit: tt.limit}
+			for _, w := range tt.writes {
+				if n, err := tb.Write([]byte(w)); n != len(w) || err != nil {
+					t.Fatalf("Write(%q) = %d, %v", w, n, err)
+				}
+			}
+			if got := string(tb.Bytes()); got != tt.want {
+				t.Fatalf("Bytes() = %q, want %q", got, tt.want)
+			}
+			if got := tb.Truncated(); got != tt.truncated {
+				t.Fatalf("Truncated() = %v, want %v", got, tt.truncated)
+			}
+		})
+	}
+}
+
+// lineWriter 记录每次 Write 的内容
+type lineWriter struct {
+	writes []string
+	err    error
+}
+
+func (lw *lineWriter) Write(p []byte) (int, error) {
+	lw.writes = append(lw.writes, string(p))
+	return len(p), lw.err
+}
+
+func TestPrefixWriter(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []string
+		want   []string
+	}{
+		{"whole lines", []string{"a\nb\n"}, []string{"> a\n", "> b\n"}},
+		{"split line", []string{"ab", "c\nd", "e\n"}, []string{"> abc\n", "> de\n"}},
+		{"partial last line", []string{"a\nbc"}, []string{"> a\n", "> bc\n"}},
+		{"only partial", []string{"x"}, []string{"> x\n"}},
+		{"empty lines", []string{"\n\n"}, []string{"> \n", "> \n"}},
+		{"nothing", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lw := &lineWriter{}
+			pw := NewPrefixWriter(lw, "> ")
+			for _, w := range tt.writes {
+				if n, err := pw.Write([]byte(w)); n != len(w) || err != nil {
+					t.Fatalf("Write(%q) = %d, %v", w, n, err)
+				}
+			}
+			if err := pw.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(lw.writes, "|") != strings.Join(tt.want, "|") {
+				t.Fatalf("writes = %q, want %q", lw.writes, tt.want)
+			}
+			// 再次 Flush 不重复写出
+			if err := pw.Flush(); err != nil || len(lw.writes) != len(tt.want) {
+				t.Fatalf("second Flush wrote %q, %v", lw.writes[len(tt.want):], err)
+			}
+		})
+	}
+}
+
+func TestPrefixWriterError(t *testing.T) {
+	want := errors.New("closed")
+	pw := NewPrefixWriter(&lineWriter{err: want}, "> ")
+	if _, err := pw.Write([]byte("a\n")); !errors.Is(err, want) {
+		t.Fatalf("Write error = %v, want %v", err, want)
+	}
+	if _, err := pw.Write([]byte("partial")); err != nil {
+		t.Fatalf("Write without newline: %v", err)
+	}
+	if err := pw.Flush(); !errors.Is(err, want) {
+		t.Fatalf("Flush error = %v, want %v", err, want)
+	}
+	var buf bytes.Buffer
+	pw = NewPrefixWriter(&buf, "")
+	pw.Write([]byte("no prefix"))
+	pw.Flush()
+	if buf.String() != "no prefix\n" {
+		t.Fatalf("output = %q", buf.String())
+	}
+}
@@ -1,12 +1,15 @@
 package usbmuxd
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"net"
 	"os"
 	"path"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/pkg/sftp"
@@ -20,73 +23,132 @@ type Dialer interface {
 	DialTimeout(network, addr string, t time.Duration) (net.Conn, error)
 }
 
+//ContextDialer 可取消的拨号, Dialer 实现该接口时优先使用
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
 //SSHUtil 设备SSH
 type SSHUtil struct {
-	UserName   string
-	Password   string
-	Network    string
-	Address    string
-	Dialer     Dialer
-	sshclient  *ssh.Client
-	sftpclient *sftp.Client
+	UserName       string
+	Password       string
+	Network        string
+	Address        string
+	Dialer         Dialer
+	Auth           *SSHAuth                //密钥/agent/keyboard-interactive 认证, nil 只使用密码
+	KnownHosts     *KnownHosts             //主机密钥校验, nil 不校验
+	HostName       string                  //主机密钥记录使用的主机名(设备为 UDID), 为空使用 Address
+	Logger         Logger                  //日志, nil 为 DefaultLogger
+	Metrics        *Metrics                //指标, nil 不记录
+	BandwidthLimit int64                   //SFTP 每个传输的速率上限(字节/秒), 0 不限速
+	OnTransfer     func(*TransferProgress) //SFTP 传输进度回调(最多每 ProgressInterval 一次, 完成时 Done)
+	StrictVerify   bool                    //上传后必须以 sha256 校验, 设备上没有 sha256sum 时失败而不是只比较大小
+	sshclient      *ssh.Client
+	sftpclient     *sftp.Client
+	sessions       chan struct{} //并发会话数限制(SSHPool), nil 不限制
+	disconnected   chan struct{} //SSH 连接断开后关闭
+	borrowed       bool          //SSHPool 借出的副本, Close 只释放引用
+}
+
+func (su *SSHUtil) logger() Logger {
+	if su.Logger == nil {
+		return DefaultLogger
+	}
+	return su.Logger
 }
 
 //ConnectSSH 连接SSH(错误: unable to authenticate)
 func (su *SSHUtil) ConnectSSH() error {
+	return su.ConnectSSHContext(context.Background())
+}
+
+//ConnectSSHContext 连接SSH, ctx 控制拨号与握手过程
+func (su *SSHUtil) ConnectSSHContext(ctx context.Context) error {
+	defer su.Metrics.sshOperation("ssh_connect", time.Now())
+	auth, err := su.Auth.methods(ctx, su.Password, su.logger())
+	if err != nil {
+		return err
+	}
+	defer auth.Close()
 	clientConfig := &ssh.ClientConfig{
 		User:    su.UserName,
-		Auth:    []ssh.AuthMethod{ssh.Password(su.Password)},
+		Auth:    auth.methods,
 		Timeout: 30 * time.Second,
 		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
 			return nil
 		},
 	}
-	if su.Dialer != nil {
-		conn, err := su.Dialer.DialTimeout(su.Network, su.Address, clientConfig.Timeout)
-		if err != nil {
-			return err
+	//握手错误不保留原始错误, 单独记录主机密钥校验结果
+	var hostKeyErr error
+	if su.KnownHosts != nil {
+		hostName := su.HostName
+		if hostName == "" {
+			hostName = su.Address
 		}
-		c, chans, reqs, err := ssh.NewClientConn(conn, su.Address, clientConfig)
-		if err != nil {
-			return err
+		callback := su.KnownHosts.HostKeyCallback(hostName, su.logger())
+		clientConfig.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			hostKeyErr = callback(hostname, remote, key)
+			return hostKeyErr
 		}
-		su.sshclient = ssh.NewClient(c, chans, reqs)
-	} else {
-		client, err := ssh.Dial(su.Network, su.Address, clientConfig)
-		if err != nil {
-			return err
+		clientConfig.HostKeyAlgorithms = su.KnownHosts.HostKeyAlgorithms(hostName)
+	}
+	ctx, cancel := context.WithTimeout(ctx, clientConfig.Timeout)
+	defer cancel()
+	var conn net.Conn
+	switch dialer := su.Dialer.(type) {
+	case ContextDialer:
+		conn, err = dialer.DialContext(ctx, su.Network, su.Address)
+	case nil:
+		conn, err = (&net.Dialer{}).DialContext(ctx, su.Network, su.Address)
+	default:
+		conn, err = dialer.DialTimeout(su.Network, su.Address, clientConfig.Timeout)
+	}
+	if err != nil {
+		return err
+	}
+	stop := watchContext(ctx, conn)
+	c, chans, reqs, err := ssh.NewClientConn(conn, su.Address, clientConfig)
+	if ctxErr := stop(); ctxErr != nil {
+		err = ctxErr
+	} else if hostKeyErr != nil {
+		err = hostKeyErr
+	}
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	su.sshclient = ssh.NewClient(c, chans, reqs)
+	su.disconnected = make(chan struct{})
+	go func(client *ssh.Client, disconnected chan struct{}) {
+		client.Wait()
+		close(disconnected)
+	}(su.sshclient, su.disconnected)
+	su.logger().Debug("ssh connected", "op", "ssh_connect", "user", su.UserName)
+	if auth.usedPassword && su.Auth != nil && su.Auth.AuthorizeKey != nil {
+		if err = su.InstallAuthorizedKey(ctx, su.Auth.AuthorizeKey); err != nil {
+			su.logger().Warn("install authorized key failed", "op", "ssh_auth", "error", err)
 		}
-		su.sshclient = client
 	}
 	return nil
 }
 
 //Command 运行命令
 func (su *SSHUtil) Command(command string, pipes []string) error {
-	session, err := su.sshclient.NewSession()
-	if err != nil {
-		return err
-	}
-	defer session.Close()
-	session.Stdout = os.Stdout
-	session.Stderr = os.Stderr
-	stdin, err := session.StdinPipe()
+	return su.CommandContext(context.Background(), command, pipes)
+}
+
+//CommandContext 运行命令(输出到 os.Stdout/os.Stderr), ctx 取消时关闭会话
+func (su *SSHUtil) CommandContext(ctx context.Context, command string, pipes []string) error {
+	result, err := su.Run(ctx, command, &RunOptions{Stdin: pipesReader(pipes), MaxOutput: -1, Stdout: os.Stdout, Stderr: os.Stderr})
 	if err != nil {
 		return err
 	}
-	if err = session.Start(command); err != nil {
-		return err
-	}
-	if pipes != nil {
-		for _, arg := range pipes {
-			stdin.Write([]byte(arg + "\n"))
-		}
-	}
-	return session.Wait()
+	return result.Err()
 }
 
 //ConnectSFTP 连接SFTP
 func (su *SSHUtil) ConnectSFTP() error {
+	defer su.Metrics.sshOperation("sftp_connect", time.Now())
 	sftpClient, err := sftp.NewClient(su.sshclient)
 	if err != nil {
 		return err
@@ -97,25 +159,26 @@ func (su *SSHUtil) ConnectSFTP() error {
 
 //UploadSFTP 上传
 func (su *SSHUtil) UploadSFTP(filePath string, toPath string) error {
-	srcFile, err := os.Open(filePath)
-	if err != nil {
-		return err
-	}
-	defer srcFile.Close()
-	su.sftpclient.Mkdir(path.Dir(toPath))
-	dstFile, err := su.sftpclient.Create(toPath)
+	return su.UploadSFTPContext(context.Background(), filePath, toPath)
+}
+
+//UploadSFTPContext 上传, ctx 取消时中止
+func (su *SSHUtil) UploadSFTPContext(ctx context.Context, filePath string, toPath string) error {
+	defer su.Metrics.sshOperation("sftp_upload", time.Now())
+	info, err := os.Stat(filePath)
 	if err != nil {
 		return err
 	}
-	defer dstFile.Close()
-	if _, err := io.Copy(dstFile, srcFile); err != nil {
-		return err
-	}
-	return nil
+	su.logger().Debug("uploading file", "op", "sftp_upload", "local", filePath, "remote", toPath)
+	return su.putFile(ctx, filePath, toPath, info)
 }
 
-//Close 关闭
+//Close 关闭(SSHPool 借出的连接只释放引用)
 func (su *SSHUtil) Close() {
+	if su.borrowed {
+		su.sftpclient, su.sshclient = nil, nil
+		return
+	}
 	if su.sftpclient != nil {
 		su.sftpclient.Close()
 		su.sftpclient = nil
@@ -128,46 +191,100 @@ func (su *SSHUtil) Close() {
 
 //InstallDEB 安装DEB
 func (su *SSHUtil) InstallDEB(filePath string) error {
-	toPath := path.Join("/var/mobile/", "install.deb")
-	if err := su.UploadSFTP(filePath, toPath); err != nil {
-		return err
-	}
-	if err := su.Command("rm -rf /var/lib/dpkg/updates/*", nil); err != nil {
-		return err
+	return su.InstallDEBContext(context.Background(), filePath)
+}
+
+//InstallDEBContext 安装DEB, ctx 取消时中止
+func (su *SSHUtil) InstallDEBContext(ctx context.Context, filePath string) error {
+	_, err := su.installDEB(ctx, []string{filePath}, &RunOptions{MaxOutput: -1, Stdout: os.Stdout, Stderr: os.Stderr})
+	return err
+}
+
+//installDEB 安装DEB(可多个, 按依赖顺序), 返回 dpkg 的结果
+func (su *SSHUtil) installDEB(ctx context.Context, files []string, opts *RunOptions) (*RunResult, error) {
+	pm, err := su.Packages(ctx)
+	if err != nil {
+		return nil, err
 	}
-	if err := su.Command(fmt.Sprintf("dpkg -i \"%s\"", toPath), nil); err != nil {
-		return err
+	pm.Options = opts
+	if err = pm.ClearUpdates(ctx); err != nil {
+		return nil, err
 	}
-	//su.runCommand("/sbin/reboot")
-	return nil
+	_, result, err := pm.Install(ctx, files...)
+	return result, err
 }
 
 //UploadFiles 上传文件
 func (su *SSHUtil) UploadFiles(localPath, remotePath string, files []string) error {
+	return su.UploadFilesContext(context.Background(), localPath, remotePath, files)
+}
+
+//UploadFilesContext 上传文件, ctx 取消时中止
+func (su *SSHUtil) UploadFilesContext(ctx context.Context, localPath, remotePath string, files []string) error {
 	for _, fileName := range files {
 		localFilePath := path.Join(localPath, fileName)
 		remoteFilePath := path.Join(remotePath, fileName)
-		if err := su.UploadSFTP(localFilePath, remoteFilePath); err != nil {
+		if err := su.UploadSFTPContext(ctx, localFilePath, remoteFilePath); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-//Service 标准服务
+//ErrServiceConfig 命令行参数错误
+var ErrServiceConfig = errors.New("invalid service config")
+
+//Service 标准服务, 参数错误或 -shell 失败时记录日志并返回 nil; 需要错误或退出码时使用 NewService
 func Service(name, description string, dependencies ...string) *DeviceControler {
+	controler, err := NewService(name, description, dependencies...)
+	if err != nil {
+		DefaultLogger.Error("service failed", "op", "service", "error", err)
+	}
+	return controler
+}
+
+//NewService 解析命令行参数创建控制器
+//
+//以守护进程命令运行(安装、启动等)时返回 nil, nil; 指定 -shell 时在第一台匹配的设备上打开交互式 shell,
+//结束后返回 nil 与 shell 的结果. 进程退出码见 ExitCode, 如:
+//
+//	controler, err := usbmuxd.NewService(name, description)
+//	if controler == nil {
+//		os.Exit(usbmuxd.ExitCode(err))
+//	}
+func NewService(name, description string, dependencies ...string) (*DeviceControler, error) {
 	fUserName := flag.String("user", "root", "Password for devices")
 	fPassword := flag.String("passwd", "", "Password for devices")
-	fUUID := flag.String("udid", "", "UUID for target device")
+	fUUID := flag.String("udid", "", "UUID or selector (e.g. \"type=iPhone13,* ios>=16 location=143*\") for target devices")
 	fCommand := flag.String("command", "", "Command for execute")
 	fUpdateDeb := flag.String("update", "", "Update for install.deb")
 	fUpdateFile := flag.String("upload", "", "Upload files. localpath,remotepath,files")
 	fReboot := flag.Bool("reboot", false, "Reboot device")
 	fRunApp := flag.String("apprun", "", "Run ios app")
+	fRunAppTime := flag.Duration("appruntime", 0, "How long -apprun keeps the app under idevicedebug, 0 for 40s, negative until the step ends")
 	fInstallApp := flag.String("appinstall", "", "path for ipa to install")
 	fUninstallApp := flag.String("appuninstall", "", "BundleID for uninstall")
+	fJob := flag.String("job", "", "Job file (JSON, or YAML with a .yaml/.yml extension) describing target, credentials and steps")
+	fConcurrency := flag.Int("concurrency", 0, "Max devices provisioned at the same time, 0 for unlimited")
+	fLimits := flag.String("limits", "", "Per-action concurrency limits. action=n,action=n (e.g. install_app=4,upload=8)")
+	fState := flag.String("state", "", "Directory for per-device step state, completed steps are skipped on replug")
+	fKeys := flag.String("key", "", "Private key files for ssh login. file,file")
+	fKeyPassword := flag.String("keypasswd", "", "Passphrase for encrypted private keys")
+	fAgent := flag.Bool("agent", false, "Use keys from ssh-agent (SSH_AUTH_SOCK)")
+	fAuthOrder := flag.String("auth", "", "SSH auth order. publickey,agent,keyboard-interactive,password")
+	fInstallKey := flag.Bool("installkey", false, "Install the first -key into authorized_keys after a password login")
+	fKnownHosts := flag.String("knownhosts", "", "known_hosts file pinning each device's ssh host key by UDID (trust on first use)")
+	fStrictHostKey := flag.Bool("stricthostkey", false, "Refuse to connect when a device's ssh host key changed")
+	fAPI := flag.String("api", "", "Listen address for the HTTP management API (e.g. 127.0.0.1:8080)")
+	fAPIToken := flag.String("apitoken", os.Getenv("USBMUXD_API_TOKEN"), "Bearer token required by the management API (default $USBMUXD_API_TOKEN)")
+	fResults := flag.String("results", "", "Append per-step results and the final summary to this JSON-lines file")
+	fWebhook := flag.String("webhook", "", "POST per-step results and the final summary as JSON to this URL")
+	fBandwidth := flag.String("bwlimit", "", "Bandwidth limit for each sftp transfer in bytes per second (e.g. 512K, 2M)")
+	fProgress := flag.Bool("progress", false, "Log sftp transfer progress for each device")
+	fStrictVerify := flag.Bool("strictverify", false, "Fail uploads that cannot be verified by sha256 on the device instead of checking the size only")
+	fShell := flag.Bool("shell", false, "Open an interactive shell on the first device matching -udid and exit with its status")
 	if !daemon.RunWithConsole(name, description, dependencies...) {
-		return nil
+		return nil, nil
 	}
 	controler := &DeviceControler{}
 	controler.UserName = *fUserName
@@ -177,8 +294,107 @@ func Service(name, description string, dependencies ...string) *DeviceControler
 	controler.UpdateDEB = *fUpdateDeb
 	controler.Reboot = *fReboot
 	controler.RunApp = *fRunApp
+	controler.AppRunTime = *fRunAppTime
 	controler.InstallApp = *fInstallApp
 	controler.UninstallApp = *fUninstallApp
 	controler.UpdateFiles = utils.SplitWithoutEmpty(*fUpdateFile, ",")
-	return controler
+	controler.APIAddr = *fAPI
+	controler.APIToken = *fAPIToken
+	controler.StrictVerify = *fStrictVerify
+	if *fBandwidth != "" {
+		limit, err := ParseBytes(*fBandwidth)
+		if err != nil {
+			return nil, fmt.Errorf("%w: -bwlimit: %w", ErrServiceConfig, err)
+		}
+		controler.BandwidthLimit = limit
+	}
+	if *fProgress {
+		controler.OnTransfer = func(device *USBDevice, progress *TransferProgress) {
+			if !progress.Done {
+				device.logger().Info("transfer progress", "op", "sftp_"+progress.Direction, "remote", progress.Remote, "progress", progress.String())
+			}
+		}
+	}
+	if *fKnownHosts != "" {
+		knownHosts, err := NewKnownHosts(*fKnownHosts, *fStrictHostKey)
+		if err != nil {
+			return nil, fmt.Errorf("%w: load known hosts %s: %w", ErrServiceConfig, *fKnownHosts, err)
+		}
+		controler.KnownHosts = knownHosts
+	}
+	if *fKeys != "" || *fAgent || *fAuthOrder != "" {
+		controler.SSHAuth = &SSHAuth{
+			KeyFiles:   utils.SplitWithoutEmpty(*fKeys, ","),
+			Passphrase: *fKeyPassword,
+			Agent:      *fAgent,
+			Order:      utils.SplitWithoutEmpty(*fAuthOrder, ","),
+		}
+		if *fInstallKey {
+			key, err := controler.SSHAuth.PublicKey()
+			if err == nil && key == nil {
+				err = errors.New("-installkey needs -key")
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%w: load ssh key: %w", ErrServiceConfig, err)
+			}
+			controler.SSHAuth.AuthorizeKey = key
+		}
+	}
+	if *fJob != "" {
+		jf, err := LoadJobFile(*fJob)
+		if err == nil {
+			err = jf.Apply(controler)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: load job file %s: %w", ErrServiceConfig, *fJob, err)
+		}
+	}
+	if *fConcurrency > 0 || *fLimits != "" {
+		limits := make(map[string]int)
+		for _, item := range utils.SplitWithoutEmpty(*fLimits, ",") {
+			action, value, _ := strings.Cut(item, "=")
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("%w: invalid action limit %q: %w", ErrServiceConfig, item, err)
+			}
+			limits[action] = n
+		}
+		controler.Pool = NewWorkerPool(*fConcurrency, limits)
+	}
+	if *fState != "" {
+		store, err := NewFileStateStore(*fState)
+		if err != nil {
+			return nil, fmt.Errorf("%w: open state store %s: %w", ErrServiceConfig, *fState, err)
+		}
+		controler.State = store
+	}
+	if *fResults != "" {
+		sink, err := NewJSONLinesSink(*fResults)
+		if err != nil {
+			return nil, fmt.Errorf("%w: open results file %s: %w", ErrServiceConfig, *fResults, err)
+		}
+		controler.Results = append(controler.Results, sink)
+	}
+	if *fWebhook != "" {
+		controler.Results = append(controler.Results, &WebhookSink{URL: *fWebhook})
+	}
+	if *fShell {
+		return nil, controler.Shell(context.Background())
+	}
+	return controler, nil
+}
+
+//ExitCode NewService 返回的错误对应的进程退出码: nil 为0, shell 以非0 状态退出时为其状态, 参数错误为2, 其他为1
+func ExitCode(err error) int {
+	var exitErr *ssh.ExitError
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &exitErr):
+		return exitErr.ExitStatus()
+	case errors.Is(err, ErrServiceConfig):
+		return 2
+	default:
+		return 1
+	}
 }
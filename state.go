@@ -0,0 +1,232 @@
+package usbmuxd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StepState 已完成步骤记录
+type StepState struct {
+	Checksum    string    `json:"checksum"`
+	CompletedAt time.Time `json:"completed_at"`
+}
+
+// DeviceState 设备流水线执行状态
+type DeviceState struct {
+	UDID      string                `json:"udid"`
+	Steps     map[string]*StepState `json:"steps"`
+	UpdatedAt time.Time             `json:"updated_at"`
+}
+
+// Completed 步骤是否已以相同输入完成
+func (state *DeviceState) Completed(key, checksum string) bool {
+	done, ok := state.Steps[key]
+	return ok && done.Checksum == checksum
+}
+
+// Complete 记录步骤完成
+func (state *DeviceState) Complete(key, checksum string) {
+	if state.Steps == nil {
+		state.Steps = make(map[string]*StepState)
+	}
+	now := time.Now()
+	state.Steps[key] = &StepState{Checksum: checksum, CompletedAt: now}
+	state.UpdatedAt = now
+}
+
+// StateStore 设备状态存储
+type StateStore interface {
+	Load(udid string) (*DeviceState, error) // 无记录时返回空状态
+	Save(state *DeviceState) error
+	Delete(udid string) error
+}
+
+// MemoryStateStore 内存状态存储
+type MemoryStateStore struct {
+	states sync.Map
+}
+
+// Load 读取状态
+func (store *MemoryStateStore) Load(udid string) (*DeviceState, error) {
+	if value, ok := store.states.Load(udid); ok {
+		data, _ := json.Marshal(value)
+		state := &DeviceState{}
+		return state, json.Unmarshal(data, state)
+	}
+	return &DeviceState{UDID: udid}, nil
+}
+
+// Save 保存状态
+func (store *MemoryStateStore) Save(state *DeviceState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	saved := &DeviceState{}
+	if err = json.Unmarshal(data, saved); err != nil {
+		return err
+	}
+	store.states.Store(state.UDID, saved)
+	return nil
+}
+
+// Delete 删除状态
+func (store *MemoryStateStore) Delete(udid string) error {
+	store.states.Delete(udid)
+	return nil
+}
+
+// FileStateStore 文件状态存储, 每台设备一个 JSON 文件
+type FileStateStore struct {
+	Dir string
+	mu  sync.Mutex
+}
+
+// NewFileStateStore 创建文件状态存储
+func NewFileStateStore(dir string) (*FileStateStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileStateStore{Dir: dir}, nil
+}
+
+func (store *FileStateStore) path(udid string) (string, error) {
+	if udid == "" || strings.ContainsAny(udid, `/\`) || udid == "." || udid == ".." {
+		return "", fmt.Errorf("invalid udid %q", udid)
+	}
+	return filepath.Join(store.Dir, udid+".json"), nil
+}
+
+// Load 读取状态
+func (store *FileStateStore) Load(udid string) (*DeviceState, error) {
+	filePath, err := store.path(udid)
+	if err != nil {
+		return nil, err
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	data, err := os.ReadFile(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return &DeviceState{UDID: udid}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	state := &DeviceState{}
+	if err = json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("parse state %s: %w", filePath, err)
+	}
+	state.UDID = udid
+	return state, nil
+}
+
+// Save 保存状态(写入临时文件后重命名)
+func (store *FileStateStore) Save(state *DeviceState) error {
+	filePath, err := store.path(state.UDID)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	tmpPath := filePath + ".tmp"
+	if err = os.WriteFile(tmpPath, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, filePath)
+}
+
+// Delete 删除状态
+func (store *FileStateStore) Delete(udid string) error {
+	filePath, err := store.path(udid)
+	if err != nil {
+		return err
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if err = os.Remove(filePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+type fileDigestKey struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// fileDigests 本地文件 sha256 缓存(按路径、大小、修改时间)
+var fileDigests sync.Map
+
+func fileDigest(filePath string) (string, error) {
+	stat, err := os.Stat(filePath)
+	if err != nil {
+		return "", err
+	}
+	key := fileDigestKey{path: filePath, size: stat.Size(), modTime: stat.ModTime()}
+	if value, ok := fileDigests.Load(key); ok {
+		return value.(string), nil
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err = io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	digest := hex.EncodeToString(hash.Sum(nil))
+	fileDigests.Store(key, digest)
+	return digest, nil
+}
+
+// stepInputs 步骤使用的本地文件, 上传文件路径与 UploadFilesContext 一致
+func stepInputs(step *Step) []string {
+	if step.Func != nil {
+		return nil
+	}
+	switch step.Action {
+	case ActionUpload:
+		files := make([]string, 0, len(step.Args)-2)
+		for _, name := range step.Args[2:] {
+			files = append(files, path.Join(step.Args[0], name))
+		}
+		return files
+	case ActionInstallDEB:
+		return step.Args
+	case ActionInstallApp:
+		return step.Args[:1]
+	}
+	return nil
+}
+
+// stepChecksum 步骤输入摘要(动作、参数及本地文件内容)
+func stepChecksum(step *Step) (string, error) {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\x00%s\x00", step.String(), step.actionName())
+	for _, arg := range step.Args {
+		fmt.Fprintf(hash, "%s\x00", arg)
+	}
+	for _, input := range stepInputs(step) {
+		digest, err := fileDigest(input)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(hash, "%s\x00", digest)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,151 @@
+package usbmuxd
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFileStateStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStateStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := store.Load("abc")
+	if err != nil || state.UDID != "abc" || len(state.Steps) != 0 {
+		t.Fatalf("Load without record = %+v, %v", state, err)
+	}
+	state.Complete("0:upload", "sum1")
+	if err = store.Save(state); err != nil {
+		t.Fatal(err)
+	}
+
+	// 新实例读取同一目录, 记录保留
+	store, err = NewFileStateStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := store.Load("abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.Completed("0:upload", "sum1") || loaded.Completed("0:upload", "sum2") || loaded.Completed("1:upload", "sum1") {
+		t.Fatalf("unexpected loaded state %+v", loaded.Steps)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "abc.json.tmp")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("temporary file left behind: %v", err)
+	}
+
+	if err = store.Delete("abc"); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Delete("abc"); err != nil {
+		t.Fatalf("Delete without record: %v", err)
+	}
+	if loaded, err = store.Load("abc"); err != nil || len(loaded.Steps) != 0 {
+		t.Fatalf("Load after Delete = %+v, %v", loaded, err)
+	}
+	for _, udid := range []string{"", ".", "..", "a/b", `a\b`} {
+		if _, err = store.Load(udid); err == nil {
+			t.Fatalf("Load(%q) succeeded", udid)
+		}
+	}
+}
+
+func TestStepChecksum(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	write := func(name, content string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("a.txt", "one")
+	write("sub/b.txt", "two")
+	step := &Step{Action: ActionUpload, Args: []string{dir, "/var/tmp", "a.txt", "sub/b.txt"}}
+	if inputs, want := stepInputs(step), []string{filepath.ToSlash(dir) + "/a.txt", filepath.ToSlash(dir) + "/sub/b.txt"}; filepath.Separator == '/' && !reflect.DeepEqual(inputs, want) {
+		t.Fatalf("stepInputs = %q, want %q", inputs, want)
+	}
+	first, err := stepChecksum(step)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := stepChecksum(step); again != first {
+		t.Fatalf("checksum changed without input change: %s != %s", again, first)
+	}
+
+	// 文件内容改变
+	write("sub/b.txt", "two, changed")
+	changed, err := stepChecksum(step)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed == first {
+		t.Fatal("checksum unchanged after file content changed")
+	}
+
+	// 远程目录改变
+	moved := &Step{Action: ActionUpload, Args: []string{dir, "/var/mobile", "a.txt", "sub/b.txt"}}
+	if other, _ := stepChecksum(moved); other == changed {
+		t.Fatal("checksum unchanged after remote directory changed")
+	}
+
+	missing := &Step{Action: ActionUpload, Args: []string{dir, "/var/tmp", "missing.txt"}}
+	if _, err = stepChecksum(missing); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("stepChecksum with missing file = %v", err)
+	}
+}
+
+func TestJobRunResume(t *testing.T) {
+	store, err := NewFileStateStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	controler := &DeviceControler{State: store}
+	device := &USBDevice{ID: 1, UDID: "abc"}
+	var runs []string
+	fail := ""
+	step := func(name string, args ...string) *Step {
+		return &Step{Name: name, Args: args, Func: func(ctx context.Context, job *Job) error {
+			runs = append(runs, name)
+			if name == fail {
+				return errors.New("failed")
+			}
+			return nil
+		}}
+	}
+	run := func(steps ...*Step) []string {
+		t.Helper()
+		runs = nil
+		err := controler.runJob(device, steps, nil)
+		if fail == "" && err != nil {
+			t.Fatal(err)
+		}
+		return runs
+	}
+	tests := []struct {
+		name  string
+		fail  string
+		steps []*Step
+		want  []string
+	}{
+		{"first run", "", []*Step{step("a"), step("b"), step("c")}, []string{"a", "b", "c"}},
+		{"all completed", "", []*Step{step("a"), step("b"), step("c")}, nil},
+		{"changed input reruns rest", "", []*Step{step("a"), step("b", "v2"), step("c")}, []string{"b", "c"}},
+		{"always step", "", []*Step{step("a"), {Name: "always", Always: true, Func: step("always").Func}, step("b", "v2")}, []string{"always", "b"}},
+		{"failed step", "c", []*Step{step("a"), step("b", "v2"), step("c", "v3"), step("d")}, []string{"c"}},
+		{"resume after failure", "", []*Step{step("a"), step("b", "v2"), step("c", "v3"), step("d")}, []string{"c", "d"}},
+	}
+	for _, tt := range tests {
+		fail = tt.fail
+		if got := run(tt.steps...); !reflect.DeepEqual(got, tt.want) {
+			t.Fatalf("%s: ran %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
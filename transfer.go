@@ -0,0 +1,342 @@
+package usbmuxd
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PartialSuffix 上传中的临时文件后缀, 完成并校验后重命名为目标文件
+const PartialSuffix = ".part"
+
+// ErrUploadVerify 上传后校验失败
+var ErrUploadVerify = errors.New("upload verification failed")
+
+// ErrChecksumUnavailable 设备上无法计算 sha256(StrictVerify 时上传失败)
+var ErrChecksumUnavailable = errors.New("remote checksum unavailable")
+
+// 传输方向
+const (
+	TransferUpload   = "upload"
+	TransferDownload = "download"
+)
+
+// ProgressInterval 传输进度回调的最小间隔
+var ProgressInterval = 500 * time.Millisecond
+
+// TransferProgress 文件传输进度
+type TransferProgress struct {
+	Direction string        `json:"direction"` // TransferUpload 或 TransferDownload
+	Local     string        `json:"local"`
+	Remote    string        `json:"remote"`
+	Bytes     int64         `json:"bytes"`          // 已传输字节数
+	Total     int64         `json:"total"`          // 文件大小
+	Rate      float64       `json:"rate"`           // 平均速率(字节/秒)
+	ETA       time.Duration `json:"eta"`            // 预计剩余时间, 未知时为0
+	Done      bool          `json:"done,omitempty"` // 传输完成(最后一次回调)
+}
+
+// Percent 完成百分比, 大小未知时为0
+func (progress *TransferProgress) Percent() float64 {
+	if progress.Total <= 0 {
+		return 0
+	}
+	return float64(progress.Bytes) * 100 / float64(progress.Total)
+}
+
+// String 如 "45.2% 12.0MiB/26.5MiB 2.1MiB/s ETA 7s"
+func (progress *TransferProgress) String() string {
+	return fmt.Sprintf("%.1f%% %s/%s %s/s ETA %s", progress.Percent(), FormatBytes(progress.Bytes), FormatBytes(progress.Total),
+		FormatBytes(int64(progress.Rate)), progress.ETA.Round(time.Second))
+}
+
+// FormatBytes 以 KiB/MiB/GiB 表示字节数
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return strconv.FormatInt(n, 10) + "B"
+	}
+	value, suffix := float64(n)/unit, 0
+	for value >= unit && suffix < 3 {
+		value /= unit
+		suffix++
+	}
+	return fmt.Sprintf("%.1f%ciB", value, "KMGT"[suffix])
+}
+
+// ParseBytes 解析字节数, 支持 K/M/G 后缀(1024 进制), 如 "512K", "2M"
+func ParseBytes(value string) (int64, error) {
+	s := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(value)), "B")
+	s = strings.TrimSuffix(s, "I")
+	multiplier := int64(1)
+	if s != "" {
+		if i := strings.IndexByte("KMG", s[len(s)-1]); i >= 0 {
+			multiplier = 1 << (10 * (i + 1))
+			s = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid byte size %q", value)
+	}
+	return int64(n * float64(multiplier)), nil
+}
+
+// transferReader 统计传输进度并限速, ctx 取消后读取返回错误
+type transferReader struct {
+	ctx        context.Context
+	reader     io.Reader
+	limit      int64 // 字节/秒, 小于等于0 不限速
+	onProgress func(*TransferProgress)
+	progress   TransferProgress
+	offset     int64 // 续传的起始位置(不计入速率)
+	start      time.Time
+	reported   time.Time
+}
+
+// transfer 包装传输的源, 使用 BandwidthLimit 与 OnTransfer
+func (su *SSHUtil) transfer(ctx context.Context, reader io.Reader, direction, local, remote string, total int64) *transferReader {
+	now := time.Now()
+	return &transferReader{
+		ctx:        ctx,
+		reader:     reader,
+		limit:      su.BandwidthLimit,
+		onProgress: su.OnTransfer,
+		progress:   TransferProgress{Direction: direction, Local: local, Remote: remote, Total: total},
+		start:      now,
+		reported:   now,
+	}
+}
+
+func (tr *transferReader) Read(p []byte) (int, error) {
+	if err := tr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if tr.limit > 0 {
+		// 每次最多读取约 1/10 秒的量, 使限速平滑
+		chunk := tr.limit / 10
+		if chunk < 1024 {
+			chunk = 1024
+		}
+		if int64(len(p)) > chunk {
+			p = p[:chunk]
+		}
+	}
+	n, err := tr.reader.Read(p)
+	tr.progress.Bytes += int64(n)
+	if tr.limit > 0 && n > 0 {
+		// 已传输量对应的最短用时
+		wait := time.Duration(float64(tr.progress.Bytes-tr.offset)/float64(tr.limit)*float64(time.Second)) - time.Since(tr.start)
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-tr.ctx.Done():
+				timer.Stop()
+				return n, tr.ctx.Err()
+			case <-timer.C:
+			}
+		}
+	}
+	if tr.onProgress != nil && time.Since(tr.reported) >= ProgressInterval {
+		tr.report(false)
+	}
+	return n, err
+}
+
+// report 回调进度
+func (tr *transferReader) report(done bool) {
+	if tr.onProgress == nil {
+		return
+	}
+	now := time.Now()
+	tr.reported = now
+	progress := tr.progress
+	progress.Done = done
+	if elapsed := now.Sub(tr.start).Seconds(); elapsed > 0 {
+		progress.Rate = float64(progress.Bytes-tr.offset) / elapsed
+	}
+	if !done && progress.Rate > 0 && progress.Total > progress.Bytes {
+		progress.ETA = time.Duration(float64(progress.Total-progress.Bytes) / progress.Rate * float64(time.Second))
+	}
+	tr.onProgress(&progress)
+}
+
+// resume 从 offset 处继续传输
+func (tr *transferReader) resume(offset int64) {
+	tr.offset, tr.progress.Bytes = offset, offset
+}
+
+// filePrefixDigest 本地文件前 n 字节的 sha256
+func filePrefixDigest(filePath string, n int64) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err = io.CopyN(hash, file, n); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// remoteDigest 远程文件前 n 字节(n 小于0 为整个文件)的 sha256, 需要设备上有 sha256sum
+func (su *SSHUtil) remoteDigest(ctx context.Context, remotePath string, n int64) (string, error) {
+	command := "sha256sum -- " + shellQuote(remotePath)
+	if n >= 0 {
+		command = "head -c " + strconv.FormatInt(n, 10) + " -- " + shellQuote(remotePath) + " | sha256sum"
+	}
+	result, err := su.Run(ctx, command, &RunOptions{MaxOutput: 4096})
+	if err == nil {
+		err = result.Err()
+	}
+	if err != nil {
+		return "", fmt.Errorf("remote sha256: %w %s", err, strings.TrimSpace(result.Stderr))
+	}
+	digest, _, _ := strings.Cut(strings.TrimSpace(result.Stdout), " ")
+	if len(digest) != sha256.Size*2 {
+		return "", fmt.Errorf("remote sha256: unexpected output %q", result.Stdout)
+	}
+	return digest, nil
+}
+
+// resumeOffset 远程临时文件可续传的长度: 不大于本地文件且前缀 sha256 一致, 否则为0
+func (su *SSHUtil) resumeOffset(ctx context.Context, localPath, partPath string, size int64) int64 {
+	info, err := su.sftpclient.Stat(partPath)
+	if err != nil || info.Size() <= 0 || info.Size() > size {
+		return 0
+	}
+	logger := su.logger()
+	remote, err := su.remoteDigest(ctx, partPath, info.Size())
+	if err != nil {
+		logger.Warn("check partial upload failed, restarting", "op", "sftp_upload", "remote", partPath, "error", err)
+		return 0
+	}
+	local, err := filePrefixDigest(localPath, info.Size())
+	if err != nil || local != remote {
+		logger.Info("partial upload does not match, restarting", "op", "sftp_upload", "remote", partPath, "bytes", info.Size())
+		return 0
+	}
+	logger.Info("resuming upload", "op", "sftp_upload", "remote", partPath, "bytes", info.Size(), "total", size)
+	return info.Size()
+}
+
+// verifyUpload 校验远程文件与本地文件一致; 设备上无法计算 sha256 时只比较大小, StrictVerify 时返回 ErrChecksumUnavailable
+func (su *SSHUtil) verifyUpload(ctx context.Context, localPath, remotePath string, size int64) error {
+	info, err := su.sftpclient.Stat(remotePath)
+	if err != nil {
+		return err
+	}
+	if info.Size() != size {
+		return fmt.Errorf("%w: %s size %d, expected %d", ErrUploadVerify, remotePath, info.Size(), size)
+	}
+	remote, err := su.remoteDigest(ctx, remotePath, -1)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if su.StrictVerify {
+			return fmt.Errorf("%w: %s: %w", ErrChecksumUnavailable, remotePath, err)
+		}
+		su.logger().Warn("remote checksum unavailable, verified size only", "op", "sftp_upload", "remote", remotePath, "error", err)
+		return nil
+	}
+	local, err := fileDigest(localPath)
+	if err != nil {
+		return err
+	}
+	if local != remote {
+		return fmt.Errorf("%w: %s sha256 %s, expected %s", ErrUploadVerify, remotePath, remote, local)
+	}
+	return nil
+}
+
+// putFile 上传文件并保留权限与修改时间
+//
+// 先写入 remotePath+PartialSuffix, 校验后重命名, 中断时目标文件不会被截断;
+// 再次上传时已写入部分的 sha256 与本地一致则从该处续传.
+func (su *SSHUtil) putFile(ctx context.Context, localPath, remotePath string, info os.FileInfo) error {
+	srcFile, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+	if err = su.sftpclient.MkdirAll(path.Dir(remotePath)); err != nil {
+		return err
+	}
+	partPath := remotePath + PartialSuffix
+	offset := su.resumeOffset(ctx, localPath, partPath, info.Size())
+	reader := su.transfer(ctx, srcFile, TransferUpload, localPath, remotePath, info.Size())
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if offset > 0 {
+		flags = os.O_WRONLY
+	}
+	dstFile, err := su.sftpclient.OpenFile(partPath, flags)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		if _, err = srcFile.Seek(offset, io.SeekStart); err == nil {
+			_, err = dstFile.Seek(offset, io.SeekStart)
+		}
+		if err != nil {
+			dstFile.Close()
+			return err
+		}
+		reader.resume(offset)
+	}
+	if _, err = io.Copy(dstFile, reader); err != nil {
+		dstFile.Close()
+		return err
+	}
+	if err = dstFile.Close(); err != nil {
+		return err
+	}
+	if err = su.verifyUpload(ctx, localPath, partPath, info.Size()); err != nil {
+		if errors.Is(err, ErrUploadVerify) {
+			su.sftpclient.Remove(partPath)
+		}
+		return err
+	}
+	reader.report(true)
+	if err = su.sftpclient.Chmod(partPath, info.Mode().Perm()); err != nil {
+		return err
+	}
+	if err = su.sftpclient.Chtimes(partPath, info.ModTime(), info.ModTime()); err != nil {
+		return err
+	}
+	if err = su.sftpclient.PosixRename(partPath, remotePath); err != nil {
+		return su.replaceFile(partPath, remotePath)
+	}
+	return nil
+}
+
+// replaceFile 不支持 posix-rename 扩展时替换目标: 目标先改名为备份, 重命名失败时恢复, 成功后删除备份
+func (su *SSHUtil) replaceFile(partPath, remotePath string) error {
+	if _, err := su.sftpclient.Lstat(remotePath); err != nil {
+		return su.sftpclient.Rename(partPath, remotePath)
+	}
+	backup := partPath + ".old"
+	su.sftpclient.Remove(backup)
+	if err := su.sftpclient.Rename(remotePath, backup); err != nil {
+		return fmt.Errorf("move %s aside: %w", remotePath, err)
+	}
+	if err := su.sftpclient.Rename(partPath, remotePath); err != nil {
+		if restoreErr := su.sftpclient.Rename(backup, remotePath); restoreErr != nil {
+			return fmt.Errorf("%w (restore %s from %s: %v)", err, remotePath, backup, restoreErr)
+		}
+		return err
+	}
+	if err := su.sftpclient.Remove(backup); err != nil {
+		su.logger().Warn("remove replaced file failed", "op", "sftp_upload", "remote", backup, "error", err)
+	}
+	return nil
+}
@@ -3,11 +3,20 @@
 package usbmuxd
 
 import (
+	"context"
 	"net"
 	"time"
 )
 
 //Tunnel 通道
 func Tunnel(d time.Duration) (net.Conn, error) {
-	return net.DialTimeout("tcp", "localhost:27015", d)
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	return TunnelContext(ctx)
+}
+
+//TunnelContext 通道(可取消)
+func TunnelContext(ctx context.Context) (net.Conn, error) {
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "tcp", "localhost:27015")
 }
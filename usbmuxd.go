@@ -7,10 +7,10 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"os/exec"
 	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -33,6 +33,9 @@ var ErrDevicePortUnavailable = errors.New("Port you're requesting is unavailable
 // ErrDevicePortUnknow 未知错误
 var ErrDevicePortUnknow = errors.New("[IDK]: Malformed request received in the device")
 
+// ErrDeviceNotFound 设备未插入或不是目标设备
+var ErrDeviceNotFound = errors.New("device not found")
+
 // USBListenRequestFrame When we want to listen for any new USB device or device removed
 type USBListenRequestFrame struct {
 	MessageType         string `plist:"MessageType"`
@@ -41,7 +44,7 @@ type USBListenRequestFrame struct {
 }
 
 // USBGenericACKFrame Its a frame model for generic response after we send listen or connect
-// Number == 0 {OK}, Number == 1 {Device not connected anymore}, Number == 2 {Port not available}, Number == 5 {IDK}
+// Number is a ResultCode: 0 {OK}, 2 {Device not connected anymore}, 3 {Port not available}, 5 {IDK}
 type USBGenericACKFrame struct {
 	MessageType string `plist:"MessageType"`
 	Number      int    `plist:"Number"`
@@ -99,6 +102,9 @@ func (header *usbmuxdHeader) Command(frame any) ([]byte, error) {
 	return header.Bytes(data.Bytes()), nil
 }
 func (header *usbmuxdHeader) Parser(data []byte, frame any) error {
+	if len(data) < frameHeaderSize-4 {
+		return ErrFrameTooShort
+	}
 	header.Version = binary.LittleEndian.Uint32(data[0:4])
 	header.Request = binary.LittleEndian.Uint32(data[4:8])
 	header.Tag = binary.LittleEndian.Uint32(data[8:12])
@@ -117,164 +123,490 @@ type USBDeviceDelegate interface {
 	USBDidReceiveErrorWhilePluggingOrUnplugging(error, string)
 }
 
+// USBDevicePairDelegate 可选接口, Delegate 实现时接收设备配对(Paired)消息
+type USBDevicePairDelegate interface {
+	USBDeviceDidPair(*USBDeviceAttachedDetachedFrame)
+}
+
+// USBDeviceReattachDelegate 可选接口, 重连 usbmuxd 后仍在线的设备分配了新的 ID 时调用(需开启 Reconcile)
+// 未实现时按拔出旧设备、插入新设备通知
+type USBDeviceReattachDelegate interface {
+	USBDeviceDidReattach(oldID int, frame *USBDeviceAttachedDetachedFrame)
+}
+
+// frameResult 读取协程的结果
+type frameResult struct {
+	frame *Frame
+	err   error
+}
+
+// DetachPolicy 监听关闭时对已知设备的处理
+type DetachPolicy int
+
+const (
+	// DetachAll 关闭时对所有已知设备通知拔出
+	DetachAll DetachPolicy = iota
+	// DetachNone 关闭时不通知
+	DetachNone
+)
+
+// DefaultReconcileWindow 重连后等待 usbmuxd 推送已连接设备的时间
+const DefaultReconcileWindow = 2 * time.Second
+
 // USBListener usbmuxd监听
 type USBListener struct {
-	Delegate USBDeviceDelegate
-	running  uint32
+	Delegate        USBDeviceDelegate
+	MaxFrameSize    uint32                               // 最大消息长度, 0 为 DefaultMaxFrameSize
+	Reconnect       *ReconnectPolicy                     // 重连策略, nil 为 DefaultReconnectPolicy
+	Reconcile       bool                                 // 重连后对比设备列表, 仍在线的设备不重复通知拔出/插入
+	ReconcileWindow time.Duration                        // 对比设备列表的等待时间, 0 为 DefaultReconcileWindow
+	OnStateChange   func(state ListenerState, err error) // 连接状态变化回调
+	CloseDetach     DetachPolicy                         // 关闭时对已知设备的处理
+	Logger          Logger                               // 日志, nil 为 DefaultLogger
+	Metrics         *Metrics                             // 指标, nil 不记录
+	dial            func() (net.Conn, error)             // 连接 usbmuxd, nil 为 Tunnel
+	running         uint32
+	mu              sync.Mutex
+	conn            net.Conn
+	stop            chan struct{}
+	done            chan struct{}
+}
+
+func (listener *USBListener) logger() Logger {
+	if listener.Logger == nil {
+		return DefaultLogger
+	}
+	return listener.Logger
+}
+
+func (listener *USBListener) setState(state ListenerState, err error) {
+	listener.logger().Debug("usbmuxd listener state", "op", "listen", "state", state.String(), "error", err)
+	if listener.OnStateChange != nil {
+		listener.OnStateChange(state, err)
+	}
 }
 
-func (listener *USBListener) listenGo() {
+func (listener *USBListener) unplug(data *USBDeviceAttachedDetachedFrame) {
+	detached := *data
+	detached.MessageType = "Detached"
+	listener.Metrics.deviceAttached(&data.Properties, -1)
+	listener.logger().Debug("device detached", "op", "listen", "device_id", data.DeviceID, "udid", data.Properties.SerialNumber)
+	listener.Delegate.USBDeviceDidUnPlug(&detached)
+}
+
+// reattach 重连后仍在线的设备: ID 未变或 Delegate 实现 USBDeviceReattachDelegate 时更新记录并返回 true,
+// 否则通知旧设备拔出并返回 false(按新插入处理)
+func (listener *USBListener) reattach(devices map[int]*USBDeviceAttachedDetachedFrame, known, data *USBDeviceAttachedDetachedFrame) bool {
+	if known.DeviceID == data.DeviceID {
+		devices[data.DeviceID] = data
+		return true
+	}
+	delegate, ok := listener.Delegate.(USBDeviceReattachDelegate)
+	if devices[known.DeviceID] == known {
+		delete(devices, known.DeviceID)
+	}
+	if !ok {
+		listener.unplug(known)
+		return false
+	}
+	devices[data.DeviceID] = data
+	listener.logger().Debug("device reattached", "op", "listen", "device_id", data.DeviceID, "old_device_id", known.DeviceID, "udid", data.Properties.SerialNumber)
+	delegate.USBDeviceDidReattach(known.DeviceID, data)
+	return true
+}
+
+func (listener *USBListener) listenGo(stop, done chan struct{}) {
+	defer close(done)
+	policy := &DefaultReconnectPolicy
+	if listener.Reconnect != nil {
+		policy = listener.Reconnect
+	}
+	devices := make(map[int]*USBDeviceAttachedDetachedFrame)
+	var err error
+	for attempt := 0; atomic.LoadUint32(&listener.running) == 1; {
+		listener.setState(ListenerConnecting, nil)
+		var connected bool
+		connected, err = listener.listenOnce(devices)
+		if atomic.LoadUint32(&listener.running) != 1 {
+			break
+		}
+		listener.logger().Warn("usbmuxd connection lost", "op", "listen", "error", err)
+		listener.setState(ListenerLost, err)
+		if !listener.Reconcile {
+			for id, data := range devices {
+				listener.unplug(data)
+				delete(devices, id)
+			}
+		}
+		if connected {
+			attempt = 0
+		}
+		attempt++
+		if policy.Exhausted(attempt) {
+			break
+		}
+		select {
+		case <-stop:
+		case <-time.After(policy.Delay(attempt)):
+		}
+	}
+	if atomic.LoadUint32(&listener.running) != 2 || listener.CloseDetach == DetachAll {
+		for _, data := range devices {
+			listener.unplug(data)
+		}
+	}
+	listener.setState(ListenerStopped, err)
+	atomic.StoreUint32(&listener.running, 0)
+}
+
+// listenOnce 建立一次监听连接, 直到连接断开; devices 为当前已知设备, 跨重连保留
+func (listener *USBListener) listenOnce(devices map[int]*USBDeviceAttachedDetachedFrame) (bool, error) {
+	var conn net.Conn
+	var err error
+	if listener.dial != nil {
+		conn, err = listener.dial()
+	} else {
+		conn, err = Tunnel(5 * time.Second)
+	}
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if !listener.setConn(conn) {
+		return false, nil
+	}
+	defer listener.setConn(nil)
+	fc := NewFrameConn(conn, listener.MaxFrameSize)
+	if err = fc.WriteFrame(1, &USBListenRequestFrame{
+		MessageType:         "Listen",
+		ProgName:            "go-usbmuxd",
+		ClientVersionString: "1.0.0",
+	}); err != nil {
+		return false, err
+	}
+	// 读取在单独协程中进行, 对比设备列表的等待由定时器控制, 不打断读取中的消息
+	frames := make(chan frameResult)
+	quit := make(chan struct{})
+	defer close(quit)
+	go func() {
+		for {
+			frame, err := fc.ReadFrame()
+			select {
+			case frames <- frameResult{frame, err}:
+			case <-quit:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	// pending 为重连前已知但尚未在新连接中确认的设备(按序列号, usbmuxd 重启后设备 ID 会改变)
+	var pending map[string]*USBDeviceAttachedDetachedFrame
+	var window *time.Timer
+	var windowC <-chan time.Time
+	defer func() {
+		if window != nil {
+			window.Stop()
+		}
+	}()
+	connected := false
 	for atomic.LoadUint32(&listener.running) == 1 {
-		if conn, err := Tunnel(5 * time.Second); err != nil {
-			log.Printf("open usbmuxd tunnel error: %v", err)
-			time.Sleep(5 * time.Second)
-		} else {
-			header := createHeader()
-			if buf, err := header.Command(&USBListenRequestFrame{
-				MessageType:         "Listen",
-				ProgName:            "go-usbmuxd",
-				ClientVersionString: "1.0.0",
-			}); err != nil {
-				panic(fmt.Errorf("create header buffer error: %v", err))
-			} else if _, err = conn.Write(buf); err != nil {
-				log.Printf("write listen header buffer error: %v", err)
-				time.Sleep(5 * time.Second)
-			} else {
-				header := &usbmuxdHeader{}
-				var frame USBGenericACKFrame
-				lenBuf := make([]byte, 4)
-				devices := make(map[int]*USBDeviceAttachedDetachedFrame)
-				for atomic.LoadUint32(&listener.running) == 1 {
-					if _, err := io.ReadFull(conn, lenBuf); err != nil {
-						log.Printf("read buffer len error: %v", err)
-						break
+		var frame *Frame
+		select {
+		case <-windowC:
+			for _, data := range pending {
+				listener.unplug(data)
+				if devices[data.DeviceID] == data {
+					delete(devices, data.DeviceID)
+				}
+			}
+			pending, windowC = nil, nil
+			continue
+		case result := <-frames:
+			if result.err != nil {
+				return connected, result.err
+			}
+			frame = result.frame
+		}
+		var ack USBGenericACKFrame
+		if err := frame.Decode(&ack); err != nil {
+			listener.Delegate.USBDidReceiveErrorWhilePluggingOrUnplugging(err, string(frame.Payload))
+		} else if ack.MessageType == "Result" {
+			if code := ResultCode(ack.Number); code != ResultOK {
+				if !connected {
+					return false, &ResultError{Code: code}
+				}
+				listener.Delegate.USBDidReceiveErrorWhilePluggingOrUnplugging(&ResultError{Code: code}, string(frame.Payload))
+			} else if !connected {
+				connected = true
+				listener.setState(ListenerConnected, nil)
+				if listener.Reconcile && len(devices) > 0 {
+					pending = make(map[string]*USBDeviceAttachedDetachedFrame, len(devices))
+					for _, data := range devices {
+						pending[data.Properties.SerialNumber] = data
 					}
-					pbuf := make([]byte, binary.LittleEndian.Uint32(lenBuf)-4)
-					if _, err := io.ReadFull(conn, pbuf); err != nil {
-						log.Printf("read buffer error: %v", err)
-						break
+					duration := listener.ReconcileWindow
+					if duration <= 0 {
+						duration = DefaultReconcileWindow
 					}
-					if err := header.Parser(pbuf, &frame); err != nil {
-						listener.Delegate.USBDidReceiveErrorWhilePluggingOrUnplugging(err, string(pbuf))
-					} else if frame.MessageType == "Result" {
-						if frame.Number != 0 {
-							listener.Delegate.USBDidReceiveErrorWhilePluggingOrUnplugging(errors.New("Illegal response received"), string(pbuf))
-						}
-					} else {
-						data := &USBDeviceAttachedDetachedFrame{}
-						if err := header.Parser(pbuf, data); err != nil {
-							listener.Delegate.USBDidReceiveErrorWhilePluggingOrUnplugging(err, string(pbuf))
-						} else if data.MessageType == "Attached" {
-							devices[data.DeviceID] = data
-							listener.Delegate.USBDeviceDidPlug(data)
-						} else if data.MessageType == "Detached" {
-							listener.Delegate.USBDeviceDidUnPlug(data)
-							delete(devices, data.DeviceID)
-						} else {
-							listener.Delegate.USBDidReceiveErrorWhilePluggingOrUnplugging(errors.New("Unable to parse the response"), string(pbuf))
-						}
+					window = time.NewTimer(duration)
+					windowC = window.C
+				}
+			}
+		} else {
+			data := &USBDeviceAttachedDetachedFrame{}
+			if err := frame.Decode(data); err != nil {
+				listener.Delegate.USBDidReceiveErrorWhilePluggingOrUnplugging(err, string(frame.Payload))
+			} else if data.MessageType == "Attached" {
+				if other, ok := devices[data.DeviceID]; ok && other.Properties.SerialNumber != data.Properties.SerialNumber && pending[other.Properties.SerialNumber] == other {
+					// ID 已分配给另一台设备, 尚未确认的旧设备已不在线
+					delete(pending, other.Properties.SerialNumber)
+					delete(devices, other.DeviceID)
+					listener.unplug(other)
+				}
+				if known, ok := pending[data.Properties.SerialNumber]; ok {
+					delete(pending, data.Properties.SerialNumber)
+					if listener.reattach(devices, known, data) {
+						continue
 					}
 				}
-				for _, data := range devices {
+				devices[data.DeviceID] = data
+				listener.logger().Debug("device attached", "op", "listen", "device_id", data.DeviceID, "udid", data.Properties.SerialNumber)
+				listener.Metrics.deviceAttached(&data.Properties, 1)
+				listener.Delegate.USBDeviceDidPlug(data)
+			} else if data.MessageType == "Detached" {
+				if known, ok := devices[data.DeviceID]; ok {
+					delete(pending, known.Properties.SerialNumber)
+				}
+				if known, ok := devices[data.DeviceID]; ok {
+					listener.unplug(known)
+				} else {
 					listener.Delegate.USBDeviceDidUnPlug(data)
 				}
-				time.Sleep(5 * time.Second)
+				delete(devices, data.DeviceID)
+			} else if data.MessageType == "Paired" {
+				if known, ok := devices[data.DeviceID]; ok {
+					paired := *known
+					paired.MessageType = data.MessageType
+					data = &paired
+				}
+				listener.logger().Debug("device paired", "op", "listen", "device_id", data.DeviceID, "udid", data.Properties.SerialNumber)
+				if delegate, ok := listener.Delegate.(USBDevicePairDelegate); ok {
+					delegate.USBDeviceDidPair(data)
+				}
+			} else {
+				listener.Delegate.USBDidReceiveErrorWhilePluggingOrUnplugging(errors.New("Unable to parse the response"), string(frame.Payload))
 			}
-			conn.Close()
 		}
 	}
-	atomic.StoreUint32(&listener.running, 0)
+	return connected, nil
+}
+
+// setConn 记录当前连接, 用于关闭时中断读取; 已关闭时返回 false
+func (listener *USBListener) setConn(conn net.Conn) bool {
+	listener.mu.Lock()
+	defer listener.mu.Unlock()
+	if conn != nil && atomic.LoadUint32(&listener.running) != 1 {
+		return false
+	}
+	listener.conn = conn
+	return true
 }
 
 // Listen 监听设备
 func (listener *USBListener) Listen() error {
+	listener.mu.Lock()
+	defer listener.mu.Unlock()
 	if atomic.CompareAndSwapUint32(&listener.running, 0, 1) {
-		go listener.listenGo()
+		listener.stop = make(chan struct{})
+		listener.done = make(chan struct{})
+		go listener.listenGo(listener.stop, listener.done)
 		return nil
 	}
-	return fmt.Errorf("listener not closed: %d", listener.running)
+	return fmt.Errorf("listener not closed: %d", atomic.LoadUint32(&listener.running))
 }
 
-// Close 监听关闭
+// Shutdown 关闭监听并等待监听协程退出, 之后可重新 Listen
+// 不可在 Delegate 回调中调用(回调运行在监听协程内)
+func (listener *USBListener) Shutdown(ctx context.Context) error {
+	listener.mu.Lock()
+	done := listener.done
+	if atomic.CompareAndSwapUint32(&listener.running, 1, 2) {
+		close(listener.stop)
+		if listener.conn != nil {
+			listener.conn.Close()
+		}
+	}
+	listener.mu.Unlock()
+	if done == nil {
+		return nil
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close 监听关闭(阻塞直到监听协程退出)
 func (listener *USBListener) Close() {
-	atomic.StoreUint32(&listener.running, 2)
+	listener.Shutdown(context.Background())
 }
 
 // USBDevice 客户端
 type USBDevice struct {
-	ID      int
-	UDID    string
-	Product int
-	Pluged  bool
-	Object  any
+	ID           int
+	UDID         string
+	Product      int
+	Pluged       bool // Deprecated: 使用 Context() 判断设备是否已拔出
+	Object       any
+	Info         *DeviceInfo   // 设备属性
+	MaxFrameSize uint32        // 最大消息长度, 0 为 DefaultMaxFrameSize
+	Logger       Logger        // 日志, nil 为 DefaultLogger
+	Metrics      *Metrics      // 指标, nil 不记录
+	AppRunTime   time.Duration // RunApp 中 idevicedebug 保持调试的时长, 0 为 DefaultAppRunTime, 小于0 为直到 ctx 结束
+	ctx          context.Context
+	cancel       context.CancelCauseFunc
+	muxID        int64 // Reattach 设置的 ID, 0 为使用 ID
+}
+
+// NewUSBDevice 创建设备, 设备 Context 在拔出(Cancel, 原因为 ErrDeviceDisconnected)或 parent 取消时取消
+func NewUSBDevice(parent context.Context, frame *USBDeviceAttachedDetachedFrame) *USBDevice {
+	device := &USBDevice{
+		ID:      frame.DeviceID,
+		UDID:    frame.Properties.SerialNumber,
+		Product: frame.Properties.ProductID,
+		Pluged:  true,
+		Info:    NewDeviceInfo(frame),
+	}
+	device.ctx, device.cancel = context.WithCancelCause(parent)
+	return device
+}
+
+// Context 设备上下文, 拔出后取消
+func (device *USBDevice) Context() context.Context {
+	if device.ctx == nil {
+		return context.Background()
+	}
+	return device.ctx
+}
+
+// Reattach usbmuxd 重启后设备分配了新的 ID, 之后的连接使用 id(ID 字段保持插入时的值)
+func (device *USBDevice) Reattach(id int) {
+	atomic.StoreInt64(&device.muxID, int64(id))
+}
+
+// MuxID 连接 usbmuxd 使用的设备 ID
+func (device *USBDevice) MuxID() int {
+	if id := atomic.LoadInt64(&device.muxID); id != 0 {
+		return int(id)
+	}
+	return device.ID
+}
+
+func (device *USBDevice) logger() Logger {
+	return WithAttrs(device.Logger, "udid", device.UDID, "device_id", device.ID)
 }
 
 func byteSwap(val int) int {
 	return ((val & 0xFF) << 8) | ((val >> 8) & 0xFF)
 }
 
+// watchContext ctx 取消时关闭 closer; 返回的函数停止监视, 若已因 ctx 关闭则返回 ctx 错误
+func watchContext(ctx context.Context, closer io.Closer) func() error {
+	if ctx.Done() == nil {
+		return func() error { return nil }
+	}
+	done := make(chan struct{})
+	result := make(chan error, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			closer.Close()
+			result <- ctx.Err()
+		case <-done:
+			result <- nil
+		}
+	}()
+	return func() error {
+		close(done)
+		return <-result
+	}
+}
+
 // Connect 连接
 func (device *USBDevice) Connect(port int, d time.Duration) (net.Conn, error) {
-	var err error
-	var conn net.Conn
-	if conn, err = Tunnel(d); err != nil {
+	ctx, cancel := context.WithTimeout(device.Context(), d)
+	defer cancel()
+	return device.ConnectContext(ctx, port)
+}
+
+// ConnectContext 连接(ctx 仅控制建立连接的过程)
+func (device *USBDevice) ConnectContext(ctx context.Context, port int) (net.Conn, error) {
+	conn, err := device.connect(ctx, port)
+	device.Metrics.connectResult(err)
+	if err != nil || device.Metrics == nil {
+		return conn, err
+	}
+	return &countingConn{Conn: conn, port: strconv.Itoa(port), metrics: device.Metrics}, nil
+}
+
+func (device *USBDevice) connect(ctx context.Context, port int) (net.Conn, error) {
+	conn, err := TunnelContext(ctx)
+	if err != nil {
 		return nil, err
 	}
-	hasError := true
-	defer func() {
-		if hasError {
-			conn.Close()
-		}
-	}()
-	header := createHeader()
-	var buf []byte
-	if buf, err = header.Command(&USBConnectRequestFrame{
-		DeviceID:            device.ID,
+	stop := watchContext(ctx, conn)
+	err = device.handshake(conn, port)
+	if ctxErr := stop(); ctxErr != nil {
+		err = ctxErr
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (device *USBDevice) handshake(conn net.Conn, port int) error {
+	fc := NewFrameConn(conn, device.MaxFrameSize)
+	if err := fc.WriteFrame(1, &USBConnectRequestFrame{
+		DeviceID:            device.MuxID(),
 		PortNumber:          byteSwap(port),
 		MessageType:         "Connect",
 		ClientVersionString: "1.0.0",
 		ProgName:            "go-usbmuxd",
 	}); err != nil {
-		return nil, err
-	}
-	if _, err = conn.Write(buf); err != nil {
-		return nil, err
-	}
-	lenBuf := make([]byte, 4)
-	if _, err = io.ReadFull(conn, lenBuf); err != nil {
-		return nil, err
+		return err
 	}
-	pbuf := make([]byte, binary.LittleEndian.Uint32(lenBuf)-4)
-	if _, err = io.ReadFull(conn, pbuf); err != nil {
-		return nil, err
+	frame, err := fc.ReadFrame()
+	if err != nil {
+		return err
 	}
-	var frame USBGenericACKFrame
-	if err = header.Parser(pbuf, &frame); err != nil {
-		return nil, err
-	} else if frame.MessageType != "Result" {
-		return nil, fmt.Errorf("unknow message type: %s", frame.MessageType)
-	} else {
-		switch frame.Number {
-		case 0:
-			hasError = false
-			return conn, nil
-		case 2:
-			// Device Disconnected
-			return nil, ErrDeviceDisconnected
-		case 3:
-			// Port isn't available/ busy
-			return nil, ErrDevicePortUnavailable
-		case 5:
-			// UNKNOWN Error
-			return nil, ErrDevicePortUnknow
-		default:
-			return nil, fmt.Errorf("Unknow error code: %d", frame.Number)
-		}
+	var ack USBGenericACKFrame
+	if err = frame.Decode(&ack); err != nil {
+		return err
+	} else if ack.MessageType != "Result" {
+		return fmt.Errorf("unknow message type: %s", ack.MessageType)
+	} else if code := ResultCode(ack.Number); code != ResultOK {
+		err = &ResultError{Code: code, DeviceID: device.MuxID(), Port: port}
+		device.logger().Debug("usbmuxd connect failed", "op", "connect", "port", port, "error", err)
+		return err
 	}
+	return nil
 }
 
 // DialTimeout 连接
 func (device *USBDevice) DialTimeout(network, addr string, t time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(device.Context(), t)
+	defer cancel()
+	return device.DialContext(ctx, network, addr)
+}
+
+// DialContext 连接
+func (device *USBDevice) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
 	if network != "usbmuxd" {
 		return nil, fmt.Errorf("Can not support: %s", network)
 	}
@@ -282,7 +614,7 @@ func (device *USBDevice) DialTimeout(network, addr string, t time.Duration) (net
 	if err != nil {
 		return nil, err
 	}
-	return device.Connect(port, t)
+	return device.ConnectContext(ctx, port)
 }
 
 // Dial 连接
@@ -290,76 +622,129 @@ func (device *USBDevice) Dial(addr string, t time.Duration) (net.Conn, error) {
 	return device.DialTimeout("usbmuxd", addr, t)
 }
 
+// DefaultAppRunTime RunApp 默认保持调试的时长
+const DefaultAppRunTime = 40 * time.Second
+
 // RunApp 运行 APP
 func (device *USBDevice) RunApp(bundleID string) error {
-	_, ideviceimagemounter, DeveloperDiskImage, idevicedebug, _, err := iMobileDeviceCMD(device.UDID)
+	return device.RunAppContext(device.Context(), bundleID)
+}
+
+// RunAppContext 运行 APP(可取消)
+func (device *USBDevice) RunAppContext(ctx context.Context, bundleID string) error {
+	_, ideviceimagemounter, DeveloperDiskImage, idevicedebug, _, err := iMobileDeviceCMD(ctx, device.UDID)
 	if err != nil {
-		log.Printf("device[%s]: error: %v", device.UDID, err)
+		device.logger().Error("find libimobiledevice tools failed", "op", "run_app", "error", err)
 		return err
 	}
-	log.Printf("device[%s]: app mounter", device.UDID)
-	ideviceimagemounterCMD := exec.Command(ideviceimagemounter, "-u", device.UDID, DeveloperDiskImage)
-	ideviceimagemounterCMD.Run()
-	log.Printf("device[%s]: app start", device.UDID)
-	idevicedebugCXT, idevicedebugCancel := context.WithTimeout(context.Background(), 40*time.Second)
+	device.logger().Info("mounting developer disk image", "op", "run_app")
+	ideviceimagemounterCMD := exec.CommandContext(ctx, ideviceimagemounter, "-u", device.UDID, DeveloperDiskImage)
+	if _, err = runTool(ctx, ideviceimagemounterCMD); err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		// 镜像已挂载时同样返回失败, 由 idevicedebug 的结果判断
+		device.logger().Warn("mount developer disk image failed", "op", "run_app", "error", err)
+	}
+	device.logger().Info("starting app", "op", "run_app", "bundle_id", bundleID)
+	// idevicedebug 在 app 运行期间不退出, 运行 AppRunTime 后结束调试
+	runTime := device.AppRunTime
+	if runTime == 0 {
+		runTime = DefaultAppRunTime
+	}
+	var idevicedebugCXT context.Context
+	var idevicedebugCancel context.CancelFunc
+	if runTime > 0 {
+		idevicedebugCXT, idevicedebugCancel = context.WithTimeout(ctx, runTime)
+	} else {
+		idevicedebugCXT, idevicedebugCancel = context.WithCancel(ctx)
+	}
 	defer idevicedebugCancel()
 	idevicedebugCMD := exec.CommandContext(idevicedebugCXT, idevicedebug, "-u", device.UDID, "run", bundleID)
-	idevicedebugCMD.Run()
-	log.Printf("device[%s]: app started", device.UDID)
+	if _, err = runTool(idevicedebugCXT, idevicedebugCMD); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if !errors.Is(err, context.DeadlineExceeded) {
+			return err
+		}
+	}
+	device.logger().Info("app started", "op", "run_app", "bundle_id", bundleID)
 	return nil
 }
 
 // InstallAPP 安装 app
 func (device *USBDevice) InstallAPP(ipa string) error {
-	ideviceinstaller, _, _, _, _, err := iMobileDeviceCMD(device.UDID)
+	return device.InstallAPPContext(device.Context(), ipa)
+}
+
+// InstallAPPContext 安装 app(可取消)
+func (device *USBDevice) InstallAPPContext(ctx context.Context, ipa string) error {
+	ideviceinstaller, _, _, _, _, err := iMobileDeviceCMD(ctx, device.UDID)
 	if err != nil {
-		log.Printf("device[%s]: error: %v", device.UDID, err)
+		device.logger().Error("find libimobiledevice tools failed", "op", "install_app", "error", err)
+		return err
+	}
+	device.logger().Info("installing app", "op", "install_app", "ipa", ipa)
+	ideviceinstallerCMD := exec.CommandContext(ctx, ideviceinstaller, "-u", device.UDID, "-i", ipa)
+	if err = runInstaller(ctx, ideviceinstallerCMD); err != nil {
+		device.logger().Error("install app failed", "op", "install_app", "error", err)
 		return err
 	}
-	log.Printf("device[%s]: app install", device.UDID)
-	ideviceinstallerCXT, ideviceinstallerCancel := context.WithTimeout(context.Background(), 20*time.Second)
-	defer ideviceinstallerCancel()
-	ideviceinstallerCMD := exec.CommandContext(ideviceinstallerCXT, ideviceinstaller, "-u", device.UDID, "-i", ipa)
-	ideviceinstallerCMD.Run()
-	log.Printf("device[%s]: app installed", device.UDID)
+	device.logger().Info("app installed", "op", "install_app", "ipa", ipa)
 	return nil
 }
 
 // UninstallAPP 卸载 app
 func (device *USBDevice) UninstallAPP(appid string) error {
-	ideviceinstaller, _, _, _, _, err := iMobileDeviceCMD(device.UDID)
+	return device.UninstallAPPContext(device.Context(), appid)
+}
+
+// UninstallAPPContext 卸载 app(可取消)
+func (device *USBDevice) UninstallAPPContext(ctx context.Context, appid string) error {
+	ideviceinstaller, _, _, _, _, err := iMobileDeviceCMD(ctx, device.UDID)
 	if err != nil {
-		log.Printf("device[%s]: error: %v", device.UDID, err)
+		device.logger().Error("find libimobiledevice tools failed", "op", "uninstall_app", "error", err)
+		return err
+	}
+	device.logger().Info("uninstalling app", "op", "uninstall_app", "bundle_id", appid)
+	ideviceinstallerCMD := exec.CommandContext(ctx, ideviceinstaller, "-u", device.UDID, "-U", appid)
+	if err = runInstaller(ctx, ideviceinstallerCMD); err != nil {
+		device.logger().Error("uninstall app failed", "op", "uninstall_app", "error", err)
 		return err
 	}
-	log.Printf("device[%s]: app uninstall", device.UDID)
-	ideviceinstallerCXT, ideviceinstallerCancel := context.WithTimeout(context.Background(), 20*time.Second)
-	defer ideviceinstallerCancel()
-	ideviceinstallerCMD := exec.CommandContext(ideviceinstallerCXT, ideviceinstaller, "-u", device.UDID, "-U", appid)
-	ideviceinstallerCMD.Run()
-	log.Printf("device[%s]: app uninstalled", device.UDID)
+	device.logger().Info("app uninstalled", "op", "uninstall_app", "bundle_id", appid)
 	return nil
 }
 
 // Reboot 重新启动
 func (device *USBDevice) Reboot() error {
-	_, _, _, _, idevicediagnostics, err := iMobileDeviceCMD(device.UDID)
+	return device.RebootContext(device.Context())
+}
+
+// RebootContext 重新启动(可取消)
+func (device *USBDevice) RebootContext(ctx context.Context) error {
+	_, _, _, _, idevicediagnostics, err := iMobileDeviceCMD(ctx, device.UDID)
 	if err != nil {
-		log.Printf("device[%s]: error: %v", device.UDID, err)
+		device.logger().Error("find libimobiledevice tools failed", "op", "reboot", "error", err)
 		return err
 	}
-	log.Printf("device[%s]: reboot", device.UDID)
-	idevicediagnosticsCXT, idevicediagnosticsCancel := context.WithTimeout(context.Background(), 20*time.Second)
-	defer idevicediagnosticsCancel()
-	idevicediagnosticsCMD := exec.CommandContext(idevicediagnosticsCXT, idevicediagnostics, "-u", device.UDID)
-	idevicediagnosticsCMD.Run()
-	log.Printf("device[%s]: app uninstalled", device.UDID)
+	device.logger().Info("rebooting", "op", "reboot")
+	idevicediagnosticsCMD := exec.CommandContext(ctx, idevicediagnostics, "-u", device.UDID)
+	if _, err = runTool(ctx, idevicediagnosticsCMD); err != nil {
+		device.logger().Error("reboot failed", "op", "reboot", "error", err)
+		return err
+	}
+	device.logger().Info("reboot requested", "op", "reboot")
 	return nil
 }
 
-// Cancel 取消
+// Cancel 取消(设备拔出), 取消设备 Context 使进行中的操作退出
 func (device *USBDevice) Cancel() {
 	device.Pluged = false
+	if device.cancel != nil {
+		device.cancel(ErrDeviceDisconnected)
+	}
 }
 
 // SSH SSH连接
@@ -369,6 +754,9 @@ func (device *USBDevice) SSH(username, passowrd string) *SSHUtil {
 		Password: passowrd,
 		Network:  "usbmuxd",
 		Address:  "22",
+		HostName: device.UDID,
 		Dialer:   device,
+		Logger:   device.logger(),
+		Metrics:  device.Metrics,
 	}
 }
@@ -0,0 +1,161 @@
+package usbmuxd
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordDelegate 记录监听回调
+type recordDelegate struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (delegate *recordDelegate) add(event string) {
+	delegate.mu.Lock()
+	delegate.events = append(delegate.events, event)
+	delegate.mu.Unlock()
+}
+
+func (delegate *recordDelegate) wait(t *testing.T, n int) []string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		delegate.mu.Lock()
+		events := append([]string(nil), delegate.events...)
+		delegate.mu.Unlock()
+		if len(events) >= n {
+			return events
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d events, got %q", n, events)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func (delegate *recordDelegate) USBDeviceDidPlug(frame *USBDeviceAttachedDetachedFrame) {
+	delegate.add(fmt.Sprintf("plug %d %s", frame.DeviceID, frame.Properties.SerialNumber))
+}
+
+func (delegate *recordDelegate) USBDeviceDidUnPlug(frame *USBDeviceAttachedDetachedFrame) {
+	delegate.add(fmt.Sprintf("unplug %d %s", frame.DeviceID, frame.Properties.SerialNumber))
+}
+
+func (delegate *recordDelegate) USBDidReceiveErrorWhilePluggingOrUnplugging(err error, _ string) {
+	delegate.add("error " + err.Error())
+}
+
+// reattachDelegate 实现 USBDeviceReattachDelegate
+type reattachDelegate struct {
+	recordDelegate
+}
+
+func (delegate *reattachDelegate) USBDeviceDidReattach(oldID int, frame *USBDeviceAttachedDetachedFrame) {
+	delegate.add(fmt.Sprintf("reattach %d->%d %s", oldID, frame.DeviceID, frame.Properties.SerialNumber))
+}
+
+// fakeMux 模拟 usbmuxd, 每次连接推送一轮设备; 最后一轮后保持连接直到关闭
+func fakeMux(rounds ...[]string) func() (net.Conn, error) {
+	var mu sync.Mutex
+	round := 0
+	return func() (net.Conn, error) {
+		mu.Lock()
+		devices := rounds[round]
+		last := round == len(rounds)-1
+		if !last {
+			round++
+		}
+		mu.Unlock()
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			fc := NewFrameConn(server, 0)
+			if _, err := fc.ReadFrame(); err != nil {
+				return
+			}
+			if err := fc.WriteFrame(1, &USBGenericACKFrame{MessageType: "Result", Number: int(ResultOK)}); err != nil {
+				return
+			}
+			for _, device := range devices {
+				var id int
+				var serial string
+				fmt.Sscanf(device, "%d %s", &id, &serial)
+				frame := &USBDeviceAttachedDetachedFrame{MessageType: "Attached", DeviceID: id}
+				frame.Properties.DeviceID = id
+				frame.Properties.SerialNumber = serial
+				if err := fc.WriteFrame(0, frame); err != nil {
+					return
+				}
+			}
+			if last {
+				fc.ReadFrame()
+			}
+		}()
+		return client, nil
+	}
+}
+
+func TestListenerReconcile(t *testing.T) {
+	tests := []struct {
+		name     string
+		delegate interface {
+			USBDeviceDelegate
+			wait(*testing.T, int) []string
+		}
+		rounds [][]string
+		want   []string
+	}{
+		{
+			name:     "same id",
+			delegate: &recordDelegate{},
+			rounds:   [][]string{{"1 A", "2 B"}, {"1 A", "2 B"}},
+			want:     []string{"plug 1 A", "plug 2 B"},
+		},
+		{
+			name:     "new id reattached by serial",
+			delegate: &reattachDelegate{},
+			rounds:   [][]string{{"1 A", "2 B"}, {"5 A", "2 C"}},
+			want:     []string{"plug 1 A", "plug 2 B", "reattach 1->5 A", "unplug 2 B", "plug 2 C"},
+		},
+		{
+			name:     "new id without reattach delegate",
+			delegate: &recordDelegate{},
+			rounds:   [][]string{{"1 A"}, {"5 A"}},
+			want:     []string{"plug 1 A", "unplug 1 A", "plug 5 A"},
+		},
+		{
+			name:     "missing after window",
+			delegate: &recordDelegate{},
+			rounds:   [][]string{{"1 A", "2 B"}, {"1 A"}},
+			want:     []string{"plug 1 A", "plug 2 B", "unplug 2 B"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listener := &USBListener{
+				Delegate:        tt.delegate,
+				Reconnect:       &ReconnectPolicy{InitialDelay: time.Millisecond},
+				Reconcile:       true,
+				ReconcileWindow: 50 * time.Millisecond,
+				CloseDetach:     DetachNone,
+				dial:            fakeMux(tt.rounds...),
+			}
+			if err := listener.Listen(); err != nil {
+				t.Fatal(err)
+			}
+			events := tt.delegate.wait(t, len(tt.want))
+			// 等待对比窗口结束, 不应再有其他回调
+			time.Sleep(100 * time.Millisecond)
+			listener.Close()
+			events = tt.delegate.wait(t, len(tt.want))
+			if !reflect.DeepEqual(events, tt.want) {
+				t.Fatalf("events = %q, want %q", events, tt.want)
+			}
+		})
+	}
+}
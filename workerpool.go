@@ -0,0 +1,203 @@
+package usbmuxd
+
+import (
+	"container/heap"
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// PoolEntry 队列中或正在执行的设备
+type PoolEntry struct {
+	UDID      string    `json:"udid"`
+	Priority  int       `json:"priority"`
+	QueuedAt  time.Time `json:"queued_at"`
+	StartedAt time.Time `json:"started_at,omitempty"`
+	Step      string    `json:"step,omitempty"` // 正在执行(或等待动作并发)的步骤
+}
+
+// PoolStatus 队列状态
+type PoolStatus struct {
+	Queued  []PoolEntry `json:"queued"`
+	Running []PoolEntry `json:"running"`
+}
+
+// PoolTicket 设备占用的执行名额
+type PoolTicket struct {
+	pool    *WorkerPool
+	entry   PoolEntry
+	seq     uint64
+	index   int
+	granted chan struct{}
+}
+
+type ticketQueue []*PoolTicket
+
+func (queue ticketQueue) Len() int { return len(queue) }
+func (queue ticketQueue) Less(i, j int) bool {
+	if queue[i].entry.Priority != queue[j].entry.Priority {
+		return queue[i].entry.Priority > queue[j].entry.Priority
+	}
+	return queue[i].seq < queue[j].seq
+}
+func (queue ticketQueue) Swap(i, j int) {
+	queue[i], queue[j] = queue[j], queue[i]
+	queue[i].index = i
+	queue[j].index = j
+}
+func (queue *ticketQueue) Push(x any) {
+	ticket := x.(*PoolTicket)
+	ticket.index = len(*queue)
+	*queue = append(*queue, ticket)
+}
+func (queue *ticketQueue) Pop() any {
+	old := *queue
+	ticket := old[len(old)-1]
+	old[len(old)-1] = nil
+	ticket.index = -1
+	*queue = old[:len(old)-1]
+	return ticket
+}
+
+// WorkerPool 设备任务并发控制: 全局名额按优先级排队, 各动作另有并发上限
+type WorkerPool struct {
+	MaxConcurrent int            // 同时执行的设备数, 0 为不限制
+	ActionLimits  map[string]int // 各动作(Action*)同时执行数, 未设置为不限制
+
+	mu      sync.Mutex
+	seq     uint64
+	queue   ticketQueue
+	running map[*PoolTicket]struct{}
+	actions map[string]chan struct{}
+}
+
+// NewWorkerPool 创建任务池
+func NewWorkerPool(maxConcurrent int, actionLimits map[string]int) *WorkerPool {
+	return &WorkerPool{MaxConcurrent: maxConcurrent, ActionLimits: actionLimits}
+}
+
+// Acquire 排队获取执行名额, 优先级高的先执行; ctx 取消时退出队列
+// pool 为 nil 时立即返回
+func (pool *WorkerPool) Acquire(ctx context.Context, udid string, priority int) (*PoolTicket, error) {
+	if pool == nil {
+		return nil, nil
+	}
+	pool.mu.Lock()
+	if pool.running == nil {
+		pool.running = make(map[*PoolTicket]struct{})
+	}
+	pool.seq++
+	ticket := &PoolTicket{
+		pool:    pool,
+		entry:   PoolEntry{UDID: udid, Priority: priority, QueuedAt: time.Now()},
+		seq:     pool.seq,
+		index:   -1,
+		granted: make(chan struct{}),
+	}
+	heap.Push(&pool.queue, ticket)
+	pool.schedule()
+	pool.mu.Unlock()
+	select {
+	case <-ticket.granted:
+		return ticket, nil
+	case <-ctx.Done():
+		pool.mu.Lock()
+		if ticket.index >= 0 {
+			heap.Remove(&pool.queue, ticket.index)
+			pool.mu.Unlock()
+			return nil, ctx.Err()
+		}
+		pool.mu.Unlock()
+		// 已获得名额
+		ticket.Release()
+		return nil, ctx.Err()
+	}
+}
+
+// schedule 按优先级分配空闲名额, 调用方需持有 mu
+func (pool *WorkerPool) schedule() {
+	for pool.queue.Len() > 0 && (pool.MaxConcurrent <= 0 || len(pool.running) < pool.MaxConcurrent) {
+		ticket := heap.Pop(&pool.queue).(*PoolTicket)
+		ticket.entry.StartedAt = time.Now()
+		pool.running[ticket] = struct{}{}
+		close(ticket.granted)
+	}
+}
+
+// Release 释放执行名额
+func (ticket *PoolTicket) Release() {
+	if ticket == nil {
+		return
+	}
+	pool := ticket.pool
+	pool.mu.Lock()
+	if _, ok := pool.running[ticket]; ok {
+		delete(pool.running, ticket)
+		pool.schedule()
+	}
+	pool.mu.Unlock()
+}
+
+// SetStep 记录当前步骤
+func (ticket *PoolTicket) SetStep(step string) {
+	if ticket == nil {
+		return
+	}
+	ticket.pool.mu.Lock()
+	ticket.entry.Step = step
+	ticket.pool.mu.Unlock()
+}
+
+// AcquireAction 获取动作并发名额, 返回释放函数
+func (pool *WorkerPool) AcquireAction(ctx context.Context, action string) (func(), error) {
+	if pool == nil {
+		return func() {}, nil
+	}
+	pool.mu.Lock()
+	limit := pool.ActionLimits[action]
+	if limit <= 0 {
+		pool.mu.Unlock()
+		return func() {}, nil
+	}
+	if pool.actions == nil {
+		pool.actions = make(map[string]chan struct{})
+	}
+	sem, ok := pool.actions[action]
+	if !ok {
+		sem = make(chan struct{}, limit)
+		pool.actions[action] = sem
+	}
+	pool.mu.Unlock()
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Status 队列与执行中的设备
+func (pool *WorkerPool) Status() PoolStatus {
+	status := PoolStatus{Queued: []PoolEntry{}, Running: []PoolEntry{}}
+	if pool == nil {
+		return status
+	}
+	pool.mu.Lock()
+	queued := make([]*PoolTicket, len(pool.queue))
+	copy(queued, pool.queue)
+	sort.Slice(queued, func(i, j int) bool {
+		return ticketQueue(queued).Less(i, j)
+	})
+	for _, ticket := range queued {
+		status.Queued = append(status.Queued, ticket.entry)
+	}
+	for ticket := range pool.running {
+		status.Running = append(status.Running, ticket.entry)
+	}
+	pool.mu.Unlock()
+	sort.Slice(status.Running, func(i, j int) bool {
+		return status.Running[i].StartedAt.Before(status.Running[j].StartedAt)
+	})
+	return status
+}
@@ -0,0 +1,202 @@
+package usbmuxd
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitQueued 等待队列中有 n 台设备
+func waitQueued(t *testing.T, pool *WorkerPool, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		queued := len(pool.Status().Queued)
+		if queued == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("queued %d devices, want %d", queued, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWorkerPoolPriority(t *testing.T) {
+	pool := NewWorkerPool(1, nil)
+	holder, err := pool.Acquire(context.Background(), "holder", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	granted := make(chan string, 4)
+	var wg sync.WaitGroup
+	queued := []struct {
+		udid     string
+		priority int
+	}{{"low1", 0}, {"high", 5}, {"low2", 0}, {"mid", 2}}
+	for i, q := range queued {
+		wg.Add(1)
+		go func(udid string, priority int) {
+			defer wg.Done()
+			ticket, err := pool.Acquire(context.Background(), udid, priority)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			granted <- udid
+			ticket.Release()
+		}(q.udid, q.priority)
+		// 依次入队, 同优先级按入队顺序
+		waitQueued(t, pool, i+1)
+	}
+
+	status := pool.Status()
+	var order []string
+	for _, entry := range status.Queued {
+		order = append(order, entry.UDID)
+	}
+	want := []string{"high", "mid", "low1", "low2"}
+	if !reflect.DeepEqual(order, want) {
+		t.Fatalf("queued order %q, want %q", order, want)
+	}
+	if len(status.Running) != 1 || status.Running[0].UDID != "holder" {
+		t.Fatalf("running %+v, want holder", status.Running)
+	}
+
+	holder.Release()
+	wg.Wait()
+	close(granted)
+	order = nil
+	for udid := range granted {
+		order = append(order, udid)
+	}
+	if !reflect.DeepEqual(order, want) {
+		t.Fatalf("granted order %q, want %q", order, want)
+	}
+	if status = pool.Status(); len(status.Queued) != 0 || len(status.Running) != 0 {
+		t.Fatalf("pool not empty after release: %+v", status)
+	}
+}
+
+func TestWorkerPoolCancel(t *testing.T) {
+	pool := NewWorkerPool(2, nil)
+	first, _ := pool.Acquire(context.Background(), "first", 0)
+	second, _ := pool.Acquire(context.Background(), "second", 0)
+	first.SetStep("upload")
+	steps := map[string]string{}
+	for _, entry := range pool.Status().Running {
+		steps[entry.UDID] = entry.Step
+	}
+	if want := map[string]string{"first": "upload", "second": ""}; !reflect.DeepEqual(steps, want) {
+		t.Fatalf("running steps %v, want %v", steps, want)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		ticket, err := pool.Acquire(ctx, "third", 0)
+		if ticket != nil {
+			err = errors.New("canceled Acquire returned a ticket")
+		}
+		done <- err
+	}()
+	waitQueued(t, pool, 1)
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("Acquire error = %v, want context.Canceled", err)
+	}
+	if status := pool.Status(); len(status.Queued) != 0 {
+		t.Fatalf("canceled device still queued: %+v", status.Queued)
+	}
+
+	// 取消的设备不占用名额
+	first.Release()
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	fourth, err := pool.Acquire(ctx, "fourth", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fourth.Release()
+	second.Release()
+	second.Release()
+	if status := pool.Status(); len(status.Running) != 0 {
+		t.Fatalf("running after release: %+v", status.Running)
+	}
+}
+
+func TestWorkerPoolActionLimits(t *testing.T) {
+	pool := NewWorkerPool(0, map[string]int{ActionInstallApp: 1, ActionCommand: 2})
+	release, err := pool.AcquireAction(context.Background(), ActionInstallApp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err = pool.AcquireAction(ctx, ActionInstallApp); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("AcquireAction over limit = %v, want context.DeadlineExceeded", err)
+	}
+	release()
+	release, err = pool.AcquireAction(context.Background(), ActionInstallApp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+
+	// 未设置上限的动作不限制
+	for i := 0; i < 10; i++ {
+		if _, err = pool.AcquireAction(context.Background(), ActionUpload); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var active, peak int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := pool.AcquireAction(context.Background(), ActionCommand)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			n := atomic.AddInt32(&active, 1)
+			for {
+				old := atomic.LoadInt32(&peak)
+				if n <= old || atomic.CompareAndSwapInt32(&peak, old, n) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			atomic.AddInt32(&active, -1)
+			release()
+		}()
+	}
+	wg.Wait()
+	if peak > 2 {
+		t.Fatalf("%d commands ran concurrently, limit 2", peak)
+	}
+}
+
+func TestWorkerPoolNil(t *testing.T) {
+	var pool *WorkerPool
+	ticket, err := pool.Acquire(context.Background(), "abc", 0)
+	if ticket != nil || err != nil {
+		t.Fatalf("nil pool Acquire = %v, %v", ticket, err)
+	}
+	ticket.SetStep("upload")
+	ticket.Release()
+	release, err := pool.AcquireAction(context.Background(), ActionUpload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if status := pool.Status(); status.Queued == nil || status.Running == nil {
+		t.Fatalf("nil pool Status = %+v", status)
+	}
+}